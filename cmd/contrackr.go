@@ -2,9 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,8 +21,44 @@ import (
 )
 
 var (
-	captureInterface string
-	metricsAddr      string
+	captureInterface    string
+	metricsAddr         string
+	minimumPortScanned  int
+	minimumHostsScanned int
+	trackerEntryTTL     time.Duration
+	evaluationInterval  time.Duration
+	aggregate           string
+	prefixV4            int
+	prefixV6            int
+	slowMinPorts        int
+	slowTTL             time.Duration
+	distributedSources  int
+	distributedTTL      time.Duration
+	distributedBlock    bool
+	servicePorts        ints
+	tripwirePorts       ints
+	tripwireSpoofable   bool
+	portWeights         weights
+	exemptListening     bool
+	listeningWeight     int
+	listeningRefresh    time.Duration
+	captureUDP          bool
+	captureSCTP         bool
+	unanswered          bool
+	stealth             bool
+	stealthFirstProbe   bool
+	fingerprintBlock    bool
+	osSignatures        string
+	pingMinHosts        int
+	pingMaxPackets      int
+	pingTTL             time.Duration
+	firewall            string
+	blockDuration       time.Duration
+	banLadder           durations
+	banFindTime         time.Duration
+	allow               string
+	allowlistFile       string
+	dryRun              bool
 )
 
 var (
@@ -26,6 +66,26 @@ var (
 		Name: "contrackr_tracked_connections",
 		Help: "The current number of tracked requests",
 	})
+	ipsBlocked = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "contrackr_blocked_ips",
+		Help: "The current number of blocked source IPs",
+	})
+	blocksTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contrackr_blocks_total",
+		Help: "The total number of times a source IP has been blocked",
+	})
+	dryRunMode = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "contrackr_dry_run",
+		Help: "Whether blocks are only being recorded, and not made on the host firewall",
+	})
+	allowlistHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "contrackr_allowlist_hits_total",
+		Help: "The total number of port scans from allowlisted source IPs",
+	})
+	detectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "contrackr_detections_total",
+		Help: "The total number of detections raised, by detector",
+	}, []string{"detector"})
 )
 
 func init() {
@@ -35,22 +95,320 @@ func init() {
 
 		defaultMetricsAddr = ":2112"
 		metricsUsage       = "the addr to listen on for metrics"
+
+		minimumPortScannedUsage  = "the number of distinct ports a source can connect to before it is a port scanner"
+		minimumHostsScannedUsage = "the number of hosts a source can connect to the same port on before it is sweeping, 0 disables"
+		trackerEntryTTLUsage     = "how long connections are tracked for, port scans are detected within this window"
+		evaluationIntervalUsage  = "how often expired connections and blocks are removed, must not be longer than -ttl"
+		aggregateUsage           = "how connections are grouped when counting ports (src-dst, src or prefix)"
+		prefixV4Usage            = "the IPv4 source prefix length connections are grouped by with -aggregate=prefix"
+		prefixV6Usage            = "the IPv6 source prefix length connections are grouped by with -aggregate=prefix"
+
+		slowMinPortsUsage = "the number of distinct ports a source can connect to within -slow-ttl before it is a low-and-slow port scanner, 0 disables"
+		slowTTLUsage      = "how long ports are remembered for when detecting low-and-slow port scans, must be longer than -ttl"
+
+		distributedSourcesUsage = "the number of distinct sources that can connect to non-service ports within -distributed-ttl before it is a distributed port scan, 0 disables"
+		distributedTTLUsage     = "the window sources are correlated within when detecting distributed port scans"
+		distributedBlockUsage   = "block every source taking part in a distributed port scan, rather than only logging it"
+		servicePortsUsage       = "comma separated ports that are served, besides those this host is listening on with -exempt-listening, connections to them are not part of a distributed port scan"
+
+		portWeightsUsage = "comma separated port:weight pairs (eg. 80:0,22:2,53/udp:0) that each port scores towards -min-ports, other ports score 1, ports are tcp unless suffixed with /udp or /sctp"
+
+		exemptListeningUsage    = "learn the TCP and UDP ports this host is listening on, so that they score -listening-weight towards -min-ports"
+		listeningWeightUsage    = "what a port this host is listening on scores towards -min-ports with -exempt-listening, 0 never counts it"
+		defaultListeningRefresh = 30 * time.Second
+		listeningRefreshUsage   = "how often the ports this host is listening on are read with -exempt-listening"
+
+		tripwirePortsUsage     = "comma separated ports that nothing legitimate connects to (eg. 23,445,3389), a single connection to one blocks the source"
+		tripwireSpoofableUsage = "also block the sources of UDP and SCTP tripwires, whose source address can be spoofed, rather than only logging them"
+
+		captureUDPUsage = "also capture inbound UDP datagrams, and the ICMP port unreachable replies to them, to detect UDP port scans"
+
+		captureSCTPUsage = "also capture SCTP INITs, to detect SCTP port scans"
+
+		unansweredUsage = "also capture the SYN-ACKs and RSTs this host answers SYNs with, and only count ports whose connection attempt failed towards -min-ports"
+
+		stealthUsage           = "also capture FIN, NULL and XMAS probes, to detect stealth port scans"
+		stealthFirstProbeUsage = "block a source on the first stealth probe it sends, implies -stealth"
+
+		fingerprintBlockUsage = "block a source on a single SYN that was sent by a scanning tool (eg. masscan or zmap) with high confidence"
+
+		osSignaturesUsage = "p0f fingerprint database (eg. p0f.fp) to guess the operating system of port scanners with"
+
+		pingMinHostsUsage   = "the number of hosts a source can send pings (or neighbour solicitations) to within -ping-ttl before it is a ping sweep, 0 disables"
+		pingMaxPacketsUsage = "the number of pings a source can send within -ping-ttl before it is a ping flood, 0 disables"
+		pingTTLUsage        = "the window pings are counted within when detecting ping sweeps and floods"
+
+		firewallUsage      = "the firewall used to block port scanners (iptables, ipset or nftables)"
+		blockDurationUsage = "how long port scanners are blocked for, 0 blocks them until exit"
+		banLadderUsage     = "comma separated block durations for repeat offenders (eg. 10m,1h,24h,0), overrides -block-duration"
+		banFindTimeUsage   = "how long an IP stays a repeat offender after its block expired, before the -ban-ladder starts over"
+
+		allowUsage         = "comma separated CIDRs whose source IPs are never blocked"
+		allowlistFileUsage = "file containing CIDRs (one per line) whose source IPs are never blocked"
+
+		dryRunUsage = "log and export the blocks that would be made, without touching the firewall"
 	)
 	flag.StringVar(&captureInterface, "interface", defaultIface, ifaceUsage)
 	flag.StringVar(&captureInterface, "i", defaultIface, ifaceUsage)
 	flag.StringVar(&metricsAddr, "port", defaultMetricsAddr, metricsUsage)
 	flag.StringVar(&metricsAddr, "p", defaultMetricsAddr, metricsUsage)
+	flag.IntVar(&minimumPortScanned, "min-ports", engine.DefaultMinimumPortScanned, minimumPortScannedUsage)
+	flag.IntVar(&minimumHostsScanned, "min-hosts", engine.DefaultMinimumHostsScanned, minimumHostsScannedUsage)
+	flag.DurationVar(&trackerEntryTTL, "ttl", engine.DefaultTrackerEntryTTL, trackerEntryTTLUsage)
+	flag.DurationVar(&evaluationInterval, "eval-interval", engine.DefaultEvaluationInterval, evaluationIntervalUsage)
+	flag.StringVar(&aggregate, "aggregate", string(engine.DefaultAggregation), aggregateUsage)
+	flag.IntVar(&prefixV4, "prefix-v4", engine.DefaultPrefixV4, prefixV4Usage)
+	flag.IntVar(&prefixV6, "prefix-v6", engine.DefaultPrefixV6, prefixV6Usage)
+	flag.IntVar(&slowMinPorts, "slow-min-ports", engine.DefaultSlowScanThreshold, slowMinPortsUsage)
+	flag.DurationVar(&slowTTL, "slow-ttl", engine.DefaultSlowScanHorizon, slowTTLUsage)
+	flag.IntVar(&distributedSources, "distributed-min-sources", 0, distributedSourcesUsage)
+	flag.DurationVar(&distributedTTL, "distributed-ttl", engine.DefaultDistributedScanWindow, distributedTTLUsage)
+	flag.BoolVar(&distributedBlock, "distributed-block", false, distributedBlockUsage)
+	flag.Var(&servicePorts, "service-ports", servicePortsUsage)
+	flag.Var(&portWeights, "port-weights", portWeightsUsage)
+	flag.BoolVar(&exemptListening, "exempt-listening", false, exemptListeningUsage)
+	flag.IntVar(&listeningWeight, "listening-weight", 0, listeningWeightUsage)
+	flag.DurationVar(&listeningRefresh, "listening-refresh", defaultListeningRefresh, listeningRefreshUsage)
+	flag.Var(&tripwirePorts, "tripwire-ports", tripwirePortsUsage)
+	flag.BoolVar(&tripwireSpoofable, "tripwire-block-spoofable", false, tripwireSpoofableUsage)
+	flag.BoolVar(&captureUDP, "udp", false, captureUDPUsage)
+	flag.BoolVar(&captureSCTP, "sctp", false, captureSCTPUsage)
+	flag.BoolVar(&unanswered, "unanswered", false, unansweredUsage)
+	flag.BoolVar(&stealth, "stealth", false, stealthUsage)
+	flag.BoolVar(&stealthFirstProbe, "stealth-first-probe", false, stealthFirstProbeUsage)
+	flag.BoolVar(&fingerprintBlock, "fingerprint-block", false, fingerprintBlockUsage)
+	flag.StringVar(&osSignatures, "os-signatures", "", osSignaturesUsage)
+	flag.IntVar(&pingMinHosts, "ping-min-hosts", 0, pingMinHostsUsage)
+	flag.IntVar(&pingMaxPackets, "ping-max-packets", 0, pingMaxPacketsUsage)
+	flag.DurationVar(&pingTTL, "ping-ttl", engine.DefaultPingScanWindow, pingTTLUsage)
+	flag.StringVar(&firewall, "firewall", string(engine.DefaultFirewall), firewallUsage)
+	flag.DurationVar(&blockDuration, "block-duration", engine.DefaultBlockDuration, blockDurationUsage)
+	flag.Var(&banLadder, "ban-ladder", banLadderUsage)
+	flag.DurationVar(&banFindTime, "ban-findtime", engine.DefaultFindTime, banFindTimeUsage)
+	flag.StringVar(&allow, "allow", "", allowUsage)
+	flag.StringVar(&allowlistFile, "allowlist-file", "", allowlistFileUsage)
+	flag.BoolVar(&dryRun, "dry-run", false, dryRunUsage)
+}
+
+// durations implements flag.Value for a comma separated list of durations.
+type durations []time.Duration
+
+func (d *durations) String() string {
+	var s []string
+	for _, v := range *d {
+		s = append(s, v.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (d *durations) Set(v string) error {
+	*d = nil
+	for _, s := range strings.Split(v, ",") {
+		dur, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		*d = append(*d, dur)
+	}
+	return nil
+}
+
+// ints implements flag.Value for a comma separated list of integers.
+type ints []int
+
+func (i *ints) String() string {
+	var s []string
+	for _, v := range *i {
+		s = append(s, strconv.Itoa(v))
+	}
+	return strings.Join(s, ",")
+}
+
+func (i *ints) Set(v string) error {
+	*i = nil
+	for _, s := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		*i = append(*i, n)
+	}
+	return nil
+}
+
+// weightedProtocols are the protocols ports can be weighted for, by the
+// suffix used in -port-weights.
+var weightedProtocols = map[string]engine.Protocol{
+	"tcp":  engine.ProtocolTCP,
+	"udp":  engine.ProtocolUDP,
+	"sctp": engine.ProtocolSCTP,
+}
+
+// weights implements flag.Value for a comma separated list of port:weight
+// pairs, where the port is TCP unless it's suffixed with its protocol (eg.
+// 53/udp).
+type weights map[engine.Protocol]map[int]int
+
+func (w *weights) String() string {
+	var s []string
+	for proto, ports := range *w {
+		for p, n := range ports {
+			s = append(s, fmt.Sprintf("%d/%s:%d", p, proto, n))
+		}
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (w *weights) Set(v string) error {
+	*w = make(weights)
+	for _, s := range strings.Split(v, ",") {
+		pw := strings.SplitN(strings.TrimSpace(s), ":", 2)
+		if len(pw) != 2 {
+			return fmt.Errorf("expected port:weight, got %q", s)
+		}
+		proto := engine.ProtocolTCP
+		if pp := strings.SplitN(pw[0], "/", 2); len(pp) == 2 {
+			var ok bool
+			if proto, ok = weightedProtocols[pp[1]]; !ok {
+				return fmt.Errorf("unknown protocol %q, expected tcp, udp or sctp", pp[1])
+			}
+			pw[0] = pp[0]
+		}
+		p, err := strconv.Atoi(pw[0])
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(pw[1])
+		if err != nil {
+			return err
+		}
+		if (*w)[proto] == nil {
+			(*w)[proto] = make(map[int]int)
+		}
+		(*w)[proto][p] = n
+	}
+	return nil
+}
+
+// detectionOptions returns the engine options that configure how port scans
+// are detected, these apply to both capturing and replaying.
+func detectionOptions() []engine.Option {
+	opts := []engine.Option{
+		engine.WithMinimumPortScanned(minimumPortScanned),
+		engine.WithMinimumHostsScanned(minimumHostsScanned),
+		engine.WithTrackerEntryTTL(trackerEntryTTL),
+		engine.WithEvaluationInterval(evaluationInterval),
+		engine.WithAggregation(engine.Aggregation(aggregate)),
+		engine.WithSourcePrefix(prefixV4, prefixV6),
+		engine.WithSlowScan(slowMinPorts, slowTTL),
+		engine.WithDistributedScan(distributedSources, distributedTTL),
+		engine.WithServicePorts(servicePorts...),
+		engine.WithTripwirePorts(tripwirePorts...),
+		engine.WithPingScan(pingMinHosts, pingMaxPackets, pingTTL),
+	}
+	for proto, w := range portWeights {
+		opts = append(opts, engine.WithPortWeights(proto, w))
+	}
+	if captureUDP {
+		opts = append(opts, engine.WithUDP())
+	}
+	if captureSCTP {
+		opts = append(opts, engine.WithSCTP())
+	}
+	if unanswered {
+		opts = append(opts, engine.WithUnansweredSYNs())
+	}
+	if stealth {
+		opts = append(opts, engine.WithStealthScan())
+	}
+	if stealthFirstProbe {
+		opts = append(opts, engine.WithStealthScanFirstProbe())
+	}
+	if fingerprintBlock {
+		opts = append(opts, engine.WithToolFingerprintBlocking())
+	}
+	if exemptListening {
+		opts = append(opts, engine.WithListeningPorts(listeningWeight, listeningRefresh))
+	}
+	return opts
+}
+
+// osOptions returns the engine options that guess the operating system of
+// port scanners, if -os-signatures is given.
+func osOptions() ([]engine.Option, error) {
+	if osSignatures == "" {
+		return nil, nil
+	}
+	f, err := os.Open(osSignatures)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db, err := engine.ReadOSSignatures(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -os-signatures: %v", err)
+	}
+	return []engine.Option{engine.WithOSSignatures(db)}, nil
 }
 
 func main() {
 	flag.Parse()
-	eng, err := engine.New(captureInterface)
+	osOpts, err := osOptions()
+	if err != nil {
+		log.Exit(err)
+	}
+	if flag.Arg(0) == "replay" {
+		if err := replay(flag.Args()[1:], os.Stdout, append(detectionOptions(), osOpts...)...); err != nil {
+			log.Exit(err)
+		}
+		return
+	}
+	opts := append(detectionOptions(), osOpts...)
+	opts = append(opts,
+		engine.WithFirewall(engine.Firewall(firewall)),
+		engine.WithBlockDuration(blockDuration),
+		engine.WithBanFindTime(banFindTime),
+	)
+	if len(banLadder) > 0 {
+		opts = append(opts, engine.WithBanLadder(banLadder...))
+	}
+	if allow != "" {
+		nets, err := engine.ParseCIDRs(strings.Split(allow, ",")...)
+		if err != nil {
+			log.Exitf("invalid -allow: %v", err)
+		}
+		opts = append(opts, engine.WithAllowlist(nets...))
+	}
+	if allowlistFile != "" {
+		f, err := os.Open(allowlistFile)
+		if err != nil {
+			log.Exit(err)
+		}
+		nets, err := engine.ReadCIDRs(f)
+		f.Close()
+		if err != nil {
+			log.Exitf("invalid -allowlist-file: %v", err)
+		}
+		opts = append(opts, engine.WithAllowlist(nets...))
+	}
+	if distributedBlock {
+		opts = append(opts, engine.WithDistributedScanBlocking())
+	}
+	if tripwireSpoofable {
+		opts = append(opts, engine.WithSpoofableTripwireBlocking())
+	}
+	if dryRun {
+		opts = append(opts, engine.WithDryRun())
+	}
+	eng, err := engine.New(captureInterface, opts...)
 	if err != nil {
 		log.Exit(err)
 	}
 
 	// Capture SIGINT, SIGTERM and run some cleanup.
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -63,9 +421,25 @@ func main() {
 	}()
 
 	go func() {
+		var lastAllowlistHits, lastBlocks int
+		lastDetections := make(map[string]int)
 		for {
 			st := eng.Stats()
 			connectionsTracked.Set(float64(st.TotalConnections))
+			ipsBlocked.Set(float64(len(st.Blocks)))
+			blocksTotal.Add(float64(st.TotalBlocks - lastBlocks))
+			lastBlocks = st.TotalBlocks
+			if st.DryRun {
+				dryRunMode.Set(1)
+			} else {
+				dryRunMode.Set(0)
+			}
+			allowlistHits.Add(float64(st.AllowlistHits - lastAllowlistHits))
+			lastAllowlistHits = st.AllowlistHits
+			for k, v := range st.Detections {
+				detectionsTotal.WithLabelValues(k).Add(float64(v - lastDetections[k]))
+				lastDetections[k] = v
+			}
 			time.Sleep(2 * time.Second)
 		}
 	}()
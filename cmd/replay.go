@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/michaelmcallister/contrackr/pkg/contrackr/engine"
+)
+
+// replay runs the replay subcommand with args, printing every Detection raised
+// by the packet capture to w.
+func replay(args []string, w io.Writer, opts ...engine.Option) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	path := fs.String("r", "", "the pcap file to replay")
+	fs.Parse(args)
+	if *path == "" {
+		return errors.New("replay: -r is required")
+	}
+
+	f, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	detected, err := engine.Replay(f, opts...)
+	if err != nil {
+		return err
+	}
+	for _, v := range detected {
+		fmt.Fprintf(w, "%s - %s %s detected: %s\n",
+			v.FirstSeen.UTC().Format(time.RFC3339), v.LastSeen.UTC().Format(time.RFC3339), v.Detector, v.Evidence)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// allowlist contains the networks whose source IPs are never blocked.
+type allowlist []*net.IPNet
+
+// Contains returns true when v is in any of the allowlisted networks.
+func (a allowlist) Contains(v *net.IP) bool {
+	for _, n := range a {
+		if n.Contains(*v) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses each of v as a CIDR (eg. 10.0.0.0/8 or 2001:db8::/32),
+// a bare IP address is treated as a network of just that address.
+func ParseCIDRs(v ...string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range v {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ReadCIDRs reads one CIDR (or IP address) per line from r. Blank lines and
+// anything after a # are ignored.
+func ReadCIDRs(r io.Reader) ([]*net.IPNet, error) {
+	var lines []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ParseCIDRs(lines...)
+}
@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadCIDRs(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		in      string
+		allowed []string
+		blocked []string
+		wantErr bool
+	}{
+		{
+			desc:    "test IPv4 and IPv6 networks",
+			in:      "10.0.0.0/8\n2001:db8::/32\n",
+			allowed: []string{"10.1.2.3", "2001:db8::1"},
+			blocked: []string{"192.168.86.158", "2001:4860:4860::8888"},
+		},
+		{
+			desc:    "test bare IPs, comments and blank lines",
+			in:      "# health checks\n\n192.168.86.158 # load balancer\n2001:4860:4860::8888\n",
+			allowed: []string{"192.168.86.158", "2001:4860:4860::8888"},
+			blocked: []string{"192.168.86.159", "2001:4860:4860::8844"},
+		},
+		{
+			desc:    "test invalid network is an error",
+			in:      "10.0.0.0/33\n",
+			wantErr: true,
+		},
+		{
+			desc:    "test invalid IP is an error",
+			in:      "not-an-ip\n",
+			wantErr: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			nets, err := ReadCIDRs(strings.NewReader(tC.in))
+			if (err != nil) != tC.wantErr {
+				t.Fatalf("ReadCIDRs() returned err=%v, want err=%t", err, tC.wantErr)
+			}
+			a := allowlist(nets)
+			for _, s := range tC.allowed {
+				ip := net.ParseIP(s)
+				if !a.Contains(&ip) {
+					t.Errorf("Contains(%s) = false, want true", s)
+				}
+			}
+			for _, s := range tC.blocked {
+				ip := net.ParseIP(s)
+				if a.Contains(&ip) {
+					t.Errorf("Contains(%s) = true, want false", s)
+				}
+			}
+		})
+	}
+}
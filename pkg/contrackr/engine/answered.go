@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// bpfAnswerFilter is the BPF filter that is used to capture the host's
+// answers to SYNs, a SYN-ACK from an open port or a RST from a closed one.
+// Like bpfFilter, IPv6 has to be matched by inspecting the flags 13 bytes into
+// the TCP header. It matches every RST the host sends, the tracker only
+// counts those that answer a SYN.
+const bpfAnswerFilter = `tcp[tcpflags] & (tcp-syn|tcp-ack) = (tcp-syn|tcp-ack)
+or tcp[tcpflags] & tcp-rst != 0
+or (ip6[6] = 6 and (ip6[13+40]&0x12 = 0x12 or ip6[13+40]&0x4 != 0))`
+
+// answerTimeout is how long a SYN can go unanswered before the connection
+// attempt has failed. The host answers a SYN in well under this, one that's
+// still unanswered was sent to a filtered port or dropped.
+const answerTimeout = 2 * time.Second
+
+// TCPReply is how the host answered a SYN, when a Connection was captured
+// from the answer.
+type TCPReply string
+
+const (
+	// ReplyNone is any connection that isn't an answer, such as a SYN.
+	ReplyNone TCPReply = ""
+	// ReplySYNACK is the answer from an open port, the connection succeeded.
+	ReplySYNACK TCPReply = "SYN-ACK"
+	// ReplyRST is the answer from a closed port, the connection failed.
+	ReplyRST TCPReply = "RST"
+)
+
+// tcpReply returns the kind of answer tcp is, or ReplyNone when it's neither
+// a SYN-ACK nor a RST.
+func tcpReply(tcp *layers.TCP) TCPReply {
+	switch {
+	case tcp.RST:
+		return ReplyRST
+	case tcp.SYN && tcp.ACK:
+		return ReplySYNACK
+	}
+	return ReplyNone
+}
@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// Block is a source IP that is blocked by the firewall, and when that block
+// expires. A zero Expiry means the IP is blocked until contrackr exits.
+type Block struct {
+	IP     net.IP
+	Expiry time.Time
+	// Offences is how many times IP has been blocked, including this time.
+	Offences int
+}
+
+// blocklist keeps track of the IPs blocked by a firewall, and unblocks them
+// as their blocks expire.
+type blocklist struct {
+	firewall BlockCloser
+	// ladder is how long to block for on each offence, the last duration is
+	// used for every offence after that.
+	ladder []time.Duration
+	done   chan struct{}
+	// stopped is closed once blocks are no longer being expired.
+	stopped chan struct{}
+	// fw serialises changes to the firewall, which are made outside of l so
+	// that a slow firewall doesn't hold up Blocks and Total.
+	fw sync.Mutex
+	// protects everything below.
+	l sync.Mutex
+	m map[string]*Block
+	// offences outlives the blocks in m, so that repeat offenders can be
+	// blocked for longer. An offender is forgotten once it has stayed clean
+	// for findTime after its block expired.
+	offences map[string]*offender
+	findTime time.Duration
+	total    int
+}
+
+// offender is how many times an IP has been blocked, and when it was last
+// blocked or unblocked.
+type offender struct {
+	n    int
+	last time.Time
+}
+
+// newBlocklist takes the firewall that IPs are blocked with, the ladder of
+// block durations for repeat offenders, and how often blocks should be
+// checked for expiry and returns an instance of blocklist. Offenders are
+// forgotten after DefaultFindTime.
+func newBlocklist(firewall BlockCloser, ladder []time.Duration, evaluationInterval time.Duration) (b *blocklist) {
+	b = &blocklist{
+		firewall: firewall,
+		ladder:   ladder,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		m:        make(map[string]*Block),
+		offences: make(map[string]*offender),
+		findTime: DefaultFindTime,
+	}
+	go func() {
+		defer close(b.stopped)
+		t := time.NewTicker(evaluationInterval)
+		defer t.Stop()
+		for {
+			select {
+			case now := <-t.C:
+				b.expire(now)
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return
+}
+
+// duration returns how long to block for on the given offence (starting at 1).
+// A duration of 0 blocks until contrackr exits.
+func (b *blocklist) duration(offence int) time.Duration {
+	if offence > len(b.ladder) {
+		return b.ladder[len(b.ladder)-1]
+	}
+	return b.ladder[offence-1]
+}
+
+// Block blocks v for as long as the ladder dictates for its next offence. If v
+// is already blocked it isn't counted as another offence, instead its expiry
+// is pushed out and the firewall isn't called again.
+func (b *blocklist) Block(v *net.IP) error {
+	b.fw.Lock()
+	defer b.fw.Unlock()
+	now := time.Now()
+	b.l.Lock()
+	if blk, ok := b.m[v.String()]; ok {
+		if d := b.duration(blk.Offences); d > 0 {
+			blk.Expiry = now.Add(d)
+		}
+		b.l.Unlock()
+		return nil
+	}
+	offence := 1
+	if o, ok := b.offences[v.String()]; ok {
+		offence = o.n + 1
+	}
+	b.l.Unlock()
+	if err := b.firewall.Block(v); err != nil {
+		return err
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.offences[v.String()] = &offender{n: offence, last: now}
+	b.total++
+	blk := &Block{IP: *v, Offences: offence}
+	if d := b.duration(offence); d > 0 {
+		blk.Expiry = now.Add(d)
+	}
+	b.m[v.String()] = blk
+	if offence > 1 {
+		log.Infof("%s is a repeat offender (%d offences), blocking for %v", v, offence, b.duration(offence))
+	}
+	return nil
+}
+
+// expire unblocks every IP whose block expired before now, and forgets the
+// offenders that have stayed clean for findTime since. IPs that fail to
+// unblock are retried next time.
+func (b *blocklist) expire(now time.Time) {
+	b.fw.Lock()
+	defer b.fw.Unlock()
+	var expired []net.IP
+	b.l.Lock()
+	for _, v := range b.m {
+		if !v.Expiry.IsZero() && !now.Before(v.Expiry) {
+			expired = append(expired, v.IP)
+		}
+	}
+	b.l.Unlock()
+	// Holding fw, nothing else changes b.m while the firewall is called.
+	for _, ip := range expired {
+		if err := b.firewall.Unblock(&ip); err != nil {
+			log.Warningf("unable to unblock %s: %v", ip, err)
+			continue
+		}
+		log.Infof("unblocked %s because block is expired", ip)
+		b.l.Lock()
+		delete(b.m, ip.String())
+		if o, ok := b.offences[ip.String()]; ok {
+			o.last = now
+		}
+		b.l.Unlock()
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	for k, o := range b.offences {
+		if _, blocked := b.m[k]; !blocked && now.Sub(o.last) >= b.findTime {
+			log.V(2).Infof("forgetting offender %s, clean since %v", k, o.last)
+			delete(b.offences, k)
+		}
+	}
+}
+
+// Blocks returns the currently blocked IPs, ordered by IP.
+func (b *blocklist) Blocks() []Block {
+	b.l.Lock()
+	blocks := make([]Block, 0, len(b.m))
+	for _, v := range b.m {
+		blocks = append(blocks, *v)
+	}
+	b.l.Unlock()
+	sort.Slice(blocks, func(i, j int) bool {
+		return bytes.Compare(blocks[i].IP.To16(), blocks[j].IP.To16()) < 0
+	})
+	return blocks
+}
+
+// Total returns how many times IPs have been blocked, a repeat offender is
+// counted for each offence.
+func (b *blocklist) Total() int {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.total
+}
+
+// Close stops expiring blocks, waiting on any expiry in progress so that the
+// firewall can be closed after it. The firewall itself is left open.
+func (b *blocklist) Close() {
+	close(b.done)
+	<-b.stopped
+}
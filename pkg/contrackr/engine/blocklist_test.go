@@ -0,0 +1,236 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// recordingBlocker implements the BlockCloser interface, keeping a list of
+// every IP blocked and unblocked.
+type recordingBlocker struct {
+	blocked, unblocked []string
+}
+
+func (rb *recordingBlocker) Block(v *net.IP) error {
+	rb.blocked = append(rb.blocked, v.String())
+	return nil
+}
+
+func (rb *recordingBlocker) Unblock(v *net.IP) error {
+	rb.unblocked = append(rb.unblocked, v.String())
+	return nil
+}
+
+func (rb *recordingBlocker) Close() error {
+	return nil
+}
+
+func TestBlocklist(t *testing.T) {
+	fw := &recordingBlocker{}
+	// Expire blocks ourselves, rather than wait on the ticker.
+	bl := newBlocklist(fw, []time.Duration{time.Minute}, time.Hour)
+	defer bl.Close()
+
+	v4, v6 := net.ParseIP("192.168.86.158"), net.ParseIP("2001:4860:4860::8888")
+	bl.Block(&v6)
+	bl.Block(&v4)
+	// Blocking again shouldn't reach the firewall.
+	bl.Block(&v4)
+
+	if diff := cmp.Diff([]string{"2001:4860:4860::8888", "192.168.86.158"}, fw.blocked); diff != "" {
+		t.Errorf("Block() mismatch (-want +got):\n%s", diff)
+	}
+
+	var got []string
+	for _, b := range bl.Blocks() {
+		got = append(got, b.IP.String())
+	}
+	if diff := cmp.Diff([]string{"192.168.86.158", "2001:4860:4860::8888"}, got); diff != "" {
+		t.Errorf("Blocks() mismatch (-want +got):\n%s", diff)
+	}
+
+	bl.expire(time.Now())
+	if len(fw.unblocked) != 0 {
+		t.Errorf("expire() unblocked %v before their blocks expired", fw.unblocked)
+	}
+	bl.expire(time.Now().Add(2 * time.Minute))
+	if diff := cmp.Diff([]string{"192.168.86.158", "2001:4860:4860::8888"}, fw.unblocked, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("expire() mismatch (-want +got):\n%s", diff)
+	}
+	if b := bl.Blocks(); len(b) != 0 {
+		t.Errorf("Blocks() = %v, want no blocks after expiry", b)
+	}
+}
+
+func TestBlocklistLadder(t *testing.T) {
+	fw := &recordingBlocker{}
+	bl := newBlocklist(fw, []time.Duration{10 * time.Minute, time.Hour, 0}, time.Hour)
+	defer bl.Close()
+
+	ip := net.ParseIP("192.168.86.158")
+	testCases := []struct {
+		desc         string
+		wantOffences int
+		wantDuration time.Duration
+	}{
+		{desc: "first offence", wantOffences: 1, wantDuration: 10 * time.Minute},
+		{desc: "second offence", wantOffences: 2, wantDuration: time.Hour},
+		{desc: "third offence is permanent", wantOffences: 3},
+	}
+	for _, tC := range testCases {
+		start := time.Now()
+		if err := bl.Block(&ip); err != nil {
+			t.Fatalf("%s: Block() = %v, want nil error", tC.desc, err)
+		}
+		got := bl.Blocks()[0]
+		if got.Offences != tC.wantOffences {
+			t.Errorf("%s: Offences = %d, want %d", tC.desc, got.Offences, tC.wantOffences)
+		}
+		if tC.wantDuration == 0 {
+			if !got.Expiry.IsZero() {
+				t.Errorf("%s: Expiry = %v, want zero", tC.desc, got.Expiry)
+			}
+		} else if d := got.Expiry.Sub(start); d < tC.wantDuration || d > tC.wantDuration+time.Second {
+			t.Errorf("%s: blocked for %v, want %v", tC.desc, d, tC.wantDuration)
+		}
+		// Let the block expire, ready for the next offence.
+		bl.expire(time.Now().Add(24 * time.Hour))
+	}
+
+	// Permanent blocks never expire.
+	if got := len(bl.Blocks()); got != 1 {
+		t.Errorf("len(Blocks()) = %d, want 1", got)
+	}
+	if diff := cmp.Diff([]string{"192.168.86.158", "192.168.86.158"}, fw.unblocked); diff != "" {
+		t.Errorf("expire() mismatch (-want +got):\n%s", diff)
+	}
+	if got := bl.Total(); got != 3 {
+		t.Errorf("Total() = %d, want 3", got)
+	}
+}
+
+func TestBlocklistForgetsOffenders(t *testing.T) {
+	fw := &recordingBlocker{}
+	bl := newBlocklist(fw, []time.Duration{time.Minute, time.Hour}, time.Hour)
+	bl.findTime = time.Hour
+	defer bl.Close()
+
+	ip := net.ParseIP("192.168.86.158")
+	offences := func() int {
+		bl.l.Lock()
+		defer bl.l.Unlock()
+		return len(bl.offences)
+	}
+	if err := bl.Block(&ip); err != nil {
+		t.Fatalf("Block() = %v, want nil error", err)
+	}
+	// The block expires, but it's still a repeat offender for findTime.
+	unblocked := time.Now().Add(2 * time.Minute)
+	bl.expire(unblocked)
+	if got := offences(); got != 1 {
+		t.Fatalf("len(offences) = %d after the block expired, want 1", got)
+	}
+	bl.expire(unblocked.Add(30 * time.Minute))
+	if got := offences(); got != 1 {
+		t.Fatalf("len(offences) = %d within findTime, want 1", got)
+	}
+	bl.expire(unblocked.Add(time.Hour))
+	if got := offences(); got != 0 {
+		t.Fatalf("len(offences) = %d once clean for findTime, want 0", got)
+	}
+	// Its next block starts at the bottom of the ladder again.
+	if err := bl.Block(&ip); err != nil {
+		t.Fatalf("Block() = %v, want nil error", err)
+	}
+	if got := bl.Blocks()[0].Offences; got != 1 {
+		t.Errorf("Offences = %d, want 1", got)
+	}
+}
+
+// slowBlocker implements the BlockCloser interface, closing entered and then
+// blocking until release is closed.
+type slowBlocker struct {
+	recordingBlocker
+	entered, release chan struct{}
+}
+
+func (sb *slowBlocker) Block(v *net.IP) error {
+	close(sb.entered)
+	<-sb.release
+	return sb.recordingBlocker.Block(v)
+}
+
+func TestBlocklistSlowFirewall(t *testing.T) {
+	fw := &slowBlocker{entered: make(chan struct{}), release: make(chan struct{})}
+	bl := newBlocklist(fw, []time.Duration{time.Minute}, time.Hour)
+	defer bl.Close()
+
+	ip := net.ParseIP("192.168.86.158")
+	blocked := make(chan error)
+	go func() {
+		blocked <- bl.Block(&ip)
+	}()
+	// The firewall is stuck blocking, but the blocklist can still be read.
+	<-fw.entered
+	read := make(chan struct{})
+	go func() {
+		bl.Blocks()
+		bl.Total()
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Blocks() and Total() waited on the firewall")
+	}
+	close(fw.release)
+	if err := <-blocked; err != nil {
+		t.Fatalf("Block() = %v, want nil error", err)
+	}
+	if got := len(bl.Blocks()); got != 1 {
+		t.Errorf("len(Blocks()) = %d, want 1", got)
+	}
+}
+
+// slowUnblocker is a recordingBlocker whose Unblock waits to be released.
+type slowUnblocker struct {
+	recordingBlocker
+	entered, release chan struct{}
+}
+
+func (su *slowUnblocker) Unblock(v *net.IP) error {
+	close(su.entered)
+	<-su.release
+	return su.recordingBlocker.Unblock(v)
+}
+
+func TestBlocklistCloseWaitsOnExpiry(t *testing.T) {
+	fw := &slowUnblocker{entered: make(chan struct{}), release: make(chan struct{})}
+	bl := newBlocklist(fw, []time.Duration{time.Millisecond}, time.Millisecond)
+
+	ip := net.ParseIP("192.168.86.158")
+	if err := bl.Block(&ip); err != nil {
+		t.Fatalf("Block() = %v, want nil error", err)
+	}
+	// The firewall is stuck unblocking, Close mustn't return until it's done.
+	<-fw.entered
+	closed := make(chan struct{})
+	go func() {
+		bl.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close() returned while the firewall was unblocking")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(fw.release)
+	<-closed
+	if diff := cmp.Diff([]string{"192.168.86.158"}, fw.unblocked); diff != "" {
+		t.Errorf("unblocked mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"io"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/google/gopacket"
@@ -14,7 +17,9 @@ import (
 
 // captureBytes is the maximum bytes per packet to capture.
 // It is intended to capture the header in all cases, and not much more else.
-const captureBytes = 80
+// ICMP port unreachable replies quote the IP and UDP headers they are replying
+// to, so are the longest.
+const captureBytes = 128
 
 // bpfFilter is the BPF filter that is used to capture TCP SYN packets.
 // I did not know until writing this, but libpcap does not support
@@ -23,7 +28,9 @@ const captureBytes = 80
 // and we check to see if the SYN flag is set.
 // TCP Header format is as such:
 // -----------------------------------------------------------------
-//     0                   1                   2                   3
+//
+//	0                   1                   2                   3
+//
 // 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
 // +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 // |          Source Port          |       Destination Port        |
@@ -46,9 +53,128 @@ const bpfFilter = `tcp[tcpflags] &(tcp-syn) != 0
 and tcp[tcpflags] &(tcp-ack) = 0 
 or (ip6[13+40]&0x2 != 0 and ip6[13+40]&0x10 = 0)`
 
+// bpfUnreachableFilter is the BPF filter that is used to capture the ICMP port
+// unreachable replies the host sends back to UDP datagrams on closed ports.
+// Like bpfFilter, ICMPv6 has to be matched by inspecting the type (1, for
+// destination unreachable) and code (4, for port unreachable) directly after
+// the IPv6 header.
+const bpfUnreachableFilter = `icmp[icmptype] = icmp-unreach and icmp[icmpcode] = 3
+or (icmp6 and ip6[40] = 1 and ip6[41] = 4)`
+
+// bpfSCTPFilter is the BPF filter that is used to capture SCTP packets whose
+// first chunk is an INIT (type 1), the SCTP equivalent of a TCP SYN. The chunk
+// type follows the 12 byte SCTP common header, which follows an IPv4 header of
+// variable length or a 40 byte IPv6 header.
+const bpfSCTPFilter = `(ip proto 132 and ip[(ip[0]&0xf)*4+12] = 1)
+or (ip6[6] = 132 and ip6[40+12] = 1)`
+
+// captureConfig is what is captured on top of inbound TCP SYNs.
+type captureConfig struct {
+	// udp captures inbound UDP datagrams, and the ICMP port unreachable
+	// replies sent back to them. The datagrams the host sends are captured
+	// too, so that the replies to them aren't mistaken for probes.
+	udp bool
+	// stealth captures stealth probes, see bpfStealthFilter.
+	stealth bool
+	// icmp captures ICMP echo requests, and ICMPv6 echo requests and
+	// neighbour solicitations.
+	icmp bool
+	// sctp captures SCTP INITs.
+	sctp bool
+	// answers captures the SYN-ACKs and RSTs the host answers SYNs with.
+	answers bool
+}
+
+// filter returns the BPF filter for inbound packets.
+func (c captureConfig) filter() string {
+	filter := bpfFilter
+	if c.udp {
+		filter += " or udp"
+	}
+	if c.stealth {
+		filter = fmt.Sprintf("%s or %s", filter, bpfStealthFilter)
+	}
+	if c.icmp {
+		filter = fmt.Sprintf("%s or %s", filter, bpfPingFilter)
+	}
+	if c.sctp {
+		filter = fmt.Sprintf("%s or %s", filter, bpfSCTPFilter)
+	}
+	return filter
+}
+
+// replyFilter returns the BPF filter for the replies the host sends, or ""
+// when none are captured.
+func (c captureConfig) replyFilter() string {
+	var filters []string
+	if c.udp {
+		filters = append(filters, "("+bpfUnreachableFilter+")", "udp")
+	}
+	if c.answers {
+		filters = append(filters, "("+bpfAnswerFilter+")")
+	}
+	return strings.Join(filters, " or ")
+}
+
+// Protocol is the transport protocol of a Connection.
+type Protocol uint8
+
+const (
+	ProtocolTCP Protocol = iota
+	ProtocolUDP
+	// ProtocolICMP is ICMP or ICMPv6, which have no ports.
+	ProtocolICMP
+	ProtocolSCTP
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolTCP:
+		return "tcp"
+	case ProtocolUDP:
+		return "udp"
+	case ProtocolICMP:
+		return "icmp"
+	case ProtocolSCTP:
+		return "sctp"
+	}
+	return fmt.Sprintf("Protocol(%d)", uint8(p))
+}
+
+// hasPorts returns false for protocols without ports, such as ICMP. Their
+// Connections are ignored by the Detectors that count ports.
+func (p Protocol) hasPorts() bool {
+	return p != ProtocolICMP
+}
+
 type Connection struct {
-	Src *net.TCPAddr
-	Dst *net.TCPAddr
+	// Protocol is the transport protocol, Src and Dst are TCPAddrs whatever
+	// it is. Their ports are zero for ICMP.
+	Protocol Protocol
+	Src      *net.TCPAddr
+	Dst      *net.TCPAddr
+	// Unreachable is set when the connection was seen in the ICMP port
+	// unreachable reply sent back by the host, rather than on its way in.
+	Unreachable bool
+	// Stealth is the kind of stealth probe the connection was captured from,
+	// it's ProbeNone for a TCP SYN.
+	Stealth StealthProbe
+	// Reply is set when the connection was seen in the host's answer to a
+	// SYN, rather than on its way in. Src and Dst are those of the SYN.
+	Reply TCPReply
+	// Solicitation is set when the connection was captured from an ICMPv6
+	// neighbour solicitation, rather than an echo request.
+	Solicitation bool
+	// Header is the header of a TCP SYN or stealth probe, it's nil for other
+	// protocols.
+	Header *SYNHeader
+	// Time is when the packet was captured.
+	Time time.Time
+}
+
+// flowKey returns the key of the flow from src to dst.
+func flowKey(src, dst *net.TCPAddr) string {
+	return src.String() + ">" + dst.String()
 }
 
 // interfaceExists returns true when devicename is found as an interface on the
@@ -70,16 +196,20 @@ func interfaceExists(devicename string) bool {
 
 // PacketCapturer implements the io.ReadCloser interface.
 type PacketCapturer struct {
-	h   *pcap.Handle
-	out chan *Connection
+	h *pcap.Handle
+	// replies captures the ICMP port unreachable replies, the datagrams and
+	// the answers to SYNs sent by the host. It's nil unless any are captured
+	// live.
+	replies *pcap.Handle
+	cfg     captureConfig
+	// flows are the UDP flows the host sent datagrams on.
+	flows *udpFlows
+	out   chan *Connection
 }
 
-// newCapturer accepts a devicename that must exist as a network interface, and
-// then returns an instance of PacketCapturer, else an error.
-func newCapturer(devicename string) (*PacketCapturer, error) {
-	if !interfaceExists(devicename) {
-		return nil, fmt.Errorf("interface %q not found", devicename)
-	}
+// openHandle opens a live pcap handle on devicename that captures packets
+// matching filter in direction dir.
+func openHandle(devicename string, dir pcap.Direction, filter string) (*pcap.Handle, error) {
 	ih, err := pcap.NewInactiveHandle(devicename)
 	defer ih.CleanUp()
 	// TODO(michaelmcallister): consider refactoring to avoid the error checking
@@ -100,94 +230,275 @@ func newCapturer(devicename string) (*PacketCapturer, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := h.SetDirection(pcap.DirectionIn); err != nil {
+	if err := h.SetDirection(dir); err != nil {
+		h.Close()
 		return nil, err
 	}
-	if err := h.SetBPFFilter(bpfFilter); err != nil {
+	if err := h.SetBPFFilter(filter); err != nil {
+		h.Close()
 		return nil, err
 	}
-	return &PacketCapturer{h: h}, nil
+	return h, nil
+}
+
+// newCapturer accepts a devicename that must exist as a network interface, and
+// then returns an instance of PacketCapturer, else an error.
+func newCapturer(devicename string, cfg captureConfig) (*PacketCapturer, error) {
+	if !interfaceExists(devicename) {
+		return nil, fmt.Errorf("interface %q not found", devicename)
+	}
+	h, err := openHandle(devicename, pcap.DirectionIn, cfg.filter())
+	if err != nil {
+		return nil, err
+	}
+	pc := &PacketCapturer{h: h, cfg: cfg, flows: newUDPFlows()}
+	if filter := cfg.replyFilter(); filter != "" {
+		if pc.replies, err = openHandle(devicename, pcap.DirectionOut, filter); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+	return pc, nil
 }
 
 // newCapturerOffline accepts a instance of os.File and attempts to read the
 // packet data, returning an instance of PacketCapturer if successful, else
-// error.
-func newCapturerOffline(file *os.File) (*PacketCapturer, error) {
+// error. Packet captures have no direction, so the replies sent by the host
+// are read from the same file.
+func newCapturerOffline(file *os.File, cfg captureConfig) (*PacketCapturer, error) {
 	h, err := pcap.OpenOfflineFile(file)
 	if err != nil {
 		return nil, err
 	}
-	if err := h.SetBPFFilter(bpfFilter); err != nil {
+	filter := cfg.filter()
+	if replies := cfg.replyFilter(); replies != "" {
+		filter = fmt.Sprintf("(%s) or %s", filter, replies)
+	}
+	if err := h.SetBPFFilter(filter); err != nil {
 		return nil, err
 	}
-	return &PacketCapturer{h: h}, nil
+	return &PacketCapturer{h: h, cfg: cfg, flows: newUDPFlows()}, nil
 }
 
 // Parse will read from the supplied packet source and return a channel that
 // will be populated with pointers to Connection that contain the Src and Dst
 // IP:Port tuples of the inbound TCP packet. Packets that cannot be decoded,
 // have no TCP header, or do not have SYN flag (or have the SYN + ACK flag set)
-// will be silently dropped.
+// will be silently dropped, unless they are stealth probes and those are
+// captured. When UDP is captured, inbound UDP datagrams and
+// the ICMP port unreachable replies to them are returned too, and likewise
+// ICMP probes, SCTP INITs and the host's answers to SYNs when they are
+// captured.
 func (pc *PacketCapturer) Capture() chan *Connection {
 	pc.out = make(chan *Connection)
-	source := gopacket.NewPacketSource(pc.h, pc.h.LinkType())
+	var wg sync.WaitGroup
+	for _, h := range []*pcap.Handle{pc.h, pc.replies} {
+		if h == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(h *pcap.Handle) {
+			defer wg.Done()
+			pc.read(gopacket.NewPacketSource(h, h.LinkType()), h == pc.replies)
+		}(h)
+	}
 	go func() {
-		for {
-			packet, err := source.NextPacket()
-			if err == io.EOF {
-				close(pc.out)
-				break
-			} else if err != nil {
-				log.Warningf("error reading packet: %v", err)
-				log.Warning("skipping...")
-				continue
-			}
-			parsedTCP := &Connection{
-				Src: &net.TCPAddr{},
-				Dst: &net.TCPAddr{},
-			}
+		wg.Wait()
+		close(pc.out)
+	}()
+	return pc.out
+}
+
+// read sends the connections decoded from source until it's exhausted,
+// outbound is set when source only has the packets the host sent.
+func (pc *PacketCapturer) read(source *gopacket.PacketSource, outbound bool) {
+	for {
+		packet, err := source.NextPacket()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			log.Warningf("error reading packet: %v", err)
+			log.Warning("skipping...")
+			continue
+		}
+		if c := pc.decode(packet, outbound); c != nil {
+			pc.out <- c
+		}
+	}
+}
+
+// decode returns the Connection in packet, or nil if there isn't one.
+// outbound is set when the host sent packet.
+func (pc *PacketCapturer) decode(packet gopacket.Packet, outbound bool) *Connection {
+	parsedTCP := &Connection{
+		Src:  &net.TCPAddr{},
+		Dst:  &net.TCPAddr{},
+		Time: packet.Metadata().Timestamp,
+	}
+	// ipid and ttl are kept for the SYNHeader.
+	var ipid uint16
+	var ttl uint8
 
-			if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
-				ip6, _ := ipv6Layer.(*layers.IPv6)
-				parsedTCP.Src.IP = ip6.SrcIP
-				parsedTCP.Dst.IP = ip6.DstIP
+	if ipv6Layer := packet.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
+		ip6, _ := ipv6Layer.(*layers.IPv6)
+		parsedTCP.Src.IP = ip6.SrcIP
+		parsedTCP.Dst.IP = ip6.DstIP
+		ttl = ip6.HopLimit
+	}
+	if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
+		ip4, _ := ipv4Layer.(*layers.IPv4)
+		parsedTCP.Src.IP = ip4.SrcIP
+		parsedTCP.Dst.IP = ip4.DstIP
+		ipid, ttl = ip4.Id, ip4.TTL
+	}
+	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+		tcp, _ := tcpLayer.(*layers.TCP)
+		if pc.cfg.stealth {
+			parsedTCP.Stealth = stealthProbe(tcp)
+		}
+		if pc.cfg.answers {
+			if r := tcpReply(tcp); r != ReplyNone {
+				// The answer goes back to the SYN's source.
+				return &Connection{
+					Src:   &net.TCPAddr{IP: parsedTCP.Dst.IP, Port: int(tcp.DstPort)},
+					Dst:   &net.TCPAddr{IP: parsedTCP.Src.IP, Port: int(tcp.SrcPort)},
+					Reply: r,
+					Time:  parsedTCP.Time,
+				}
 			}
-			if ipv4Layer := packet.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
-				ip4, _ := ipv4Layer.(*layers.IPv4)
-				parsedTCP.Src.IP = ip4.SrcIP
-				parsedTCP.Dst.IP = ip4.DstIP
+		}
+		// This shouldn't happen as the capturer isn't configured to
+		// capture anything but SYN packets (and stealth probes and
+		// answers). The BPF Filter is applied even on pcap files that may
+		// have been generated with different filters.
+		if (!tcp.SYN || tcp.ACK) && parsedTCP.Stealth == ProbeNone {
+			log.Warning("packet is not TCP with SYN flag")
+			m := "%s:%d -> %s:%d(SYN:%t, ACK:%t)"
+			log.V(2).Infof(m, parsedTCP.Src.IP, tcp.SrcPort, parsedTCP.Dst.IP, tcp.DstPort, tcp.SYN, tcp.ACK)
+			return nil
+		}
+		parsedTCP.Src.Port = int(tcp.SrcPort)
+		parsedTCP.Dst.Port = int(tcp.DstPort)
+		parsedTCP.Header = newSYNHeader(tcp, ipid, ttl)
+	}
+	if pc.cfg.udp {
+		if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
+			udp, _ := udpLayer.(*layers.UDP)
+			parsedTCP.Protocol = ProtocolUDP
+			parsedTCP.Src.Port = int(udp.SrcPort)
+			parsedTCP.Dst.Port = int(udp.DstPort)
+			if !pc.udpProbe(parsedTCP, outbound) {
+				return nil
 			}
-			if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-				tcp, _ := tcpLayer.(*layers.TCP)
-				// This shouldn't happen as the capturer isn't configured to
-				// capture anything but SYN packets. The BPF Filter is applied
-				// even on pcap files that may have been generated with
-				// different filters.
-				if !tcp.SYN || tcp.ACK {
-					log.Warning("packet is not TCP with SYN flag")
-					m := "%s:%d -> %s:%d(SYN:%t, ACK:%t)"
-					log.V(2).Infof(m, parsedTCP.Src.IP, tcp.SrcPort, parsedTCP.Dst.IP, tcp.DstPort, tcp.SYN, tcp.ACK)
-					continue
-				}
-				parsedTCP.Src.Port = int(tcp.SrcPort)
-				parsedTCP.Dst.Port = int(tcp.DstPort)
+		}
+		if c := unreachable(packet); c != nil {
+			// The port unreachable reply to a late answer to one of the
+			// host's queries isn't a probe either.
+			if ephemeralPort(c.Dst.Port) {
+				return nil
 			}
+			parsedTCP = c
+		}
+	}
+	if pc.cfg.sctp && packet.Layer(layers.LayerTypeSCTPInit) != nil {
+		if sctpLayer := packet.Layer(layers.LayerTypeSCTP); sctpLayer != nil {
+			sctp, _ := sctpLayer.(*layers.SCTP)
+			parsedTCP.Protocol = ProtocolSCTP
+			parsedTCP.Src.Port = int(sctp.SrcPort)
+			parsedTCP.Dst.Port = int(sctp.DstPort)
+		}
+	}
+	if pc.cfg.icmp {
+		if c := ping(packet); c != nil {
+			return c
+		}
+	}
 
-			if parsedTCP.Src.IP != nil && parsedTCP.Dst.Port != 0 {
-				pc.out <- parsedTCP
-			}
+	if parsedTCP.Src.IP != nil && parsedTCP.Dst.Port != 0 {
+		return parsedTCP
+	}
+	return nil
+}
+
+// udpProbe returns true when the datagram c is a probe, rather than one the
+// host sent or a reply to one. The datagrams the host sent are recorded, so
+// that the replies to them are recognised. Packet captures have no direction,
+// so every datagram in them is recorded and is a probe unless it's a reply.
+func (pc *PacketCapturer) udpProbe(c *Connection, outbound bool) bool {
+	if outbound {
+		pc.flows.sent(c)
+		return false
+	}
+	// A reply to an ephemeral port may be read before the datagram it
+	// answers, which is captured separately, so those are never probes.
+	if ephemeralPort(c.Dst.Port) || pc.flows.reply(c) {
+		return false
+	}
+	if pc.replies == nil {
+		pc.flows.sent(c)
+	}
+	return true
+}
 
+// unreachable returns the UDP datagram quoted by an ICMP or ICMPv6 port
+// unreachable reply in packet, or nil if it isn't one. The Connection is from
+// the datagram's source, as if it were captured on its way in.
+func unreachable(packet gopacket.Packet) *Connection {
+	var quoted gopacket.Packet
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+		icmp, _ := icmpLayer.(*layers.ICMPv4)
+		if icmp.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort) {
+			return nil
 		}
-	}()
-	return pc.out
+		quoted = gopacket.NewPacket(icmp.Payload, layers.LayerTypeIPv4, gopacket.Default)
+	}
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv6); icmpLayer != nil {
+		icmp, _ := icmpLayer.(*layers.ICMPv6)
+		// The 4 bytes after the ICMPv6 header are unused.
+		if icmp.TypeCode != layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable) || len(icmp.Payload) < 4 {
+			return nil
+		}
+		quoted = gopacket.NewPacket(icmp.Payload[4:], layers.LayerTypeIPv6, gopacket.Default)
+	}
+	if quoted == nil {
+		return nil
+	}
+	c := &Connection{
+		Protocol:    ProtocolUDP,
+		Src:         &net.TCPAddr{},
+		Dst:         &net.TCPAddr{},
+		Unreachable: true,
+		Time:        packet.Metadata().Timestamp,
+	}
+	if ipv6Layer := quoted.Layer(layers.LayerTypeIPv6); ipv6Layer != nil {
+		ip6, _ := ipv6Layer.(*layers.IPv6)
+		c.Src.IP = ip6.SrcIP
+		c.Dst.IP = ip6.DstIP
+	}
+	if ipv4Layer := quoted.Layer(layers.LayerTypeIPv4); ipv4Layer != nil {
+		ip4, _ := ipv4Layer.(*layers.IPv4)
+		c.Src.IP = ip4.SrcIP
+		c.Dst.IP = ip4.DstIP
+	}
+	udpLayer := quoted.Layer(layers.LayerTypeUDP)
+	if udpLayer == nil {
+		return nil
+	}
+	udp, _ := udpLayer.(*layers.UDP)
+	c.Src.Port = int(udp.SrcPort)
+	c.Dst.Port = int(udp.DstPort)
+	return c
 }
 
-// Close closes the underlying pcap handle. It will always return a nil error.
+// Close closes the underlying pcap handles. It will always return a nil error.
 // Attempting to read after closing is discouraged.
 func (pc *PacketCapturer) Close() error {
 	// This will close the underlying channel as well.
 	if pc != nil {
 		pc.h.Close()
+		if pc.replies != nil {
+			pc.replies.Close()
+		}
 	}
 	return nil
 }
@@ -4,14 +4,33 @@ import (
 	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket/layers"
 )
 
 func TestParse(t *testing.T) {
+	linuxHeader := &SYNHeader{
+		IPID:   45289,
+		TTL:    64,
+		Window: 64240,
+		Seq:    743214452,
+		Options: []layers.TCPOptionKind{
+			layers.TCPOptionKindMSS,
+			layers.TCPOptionKindSACKPermitted,
+			layers.TCPOptionKindTimestamps,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindWindowScale,
+		},
+		MSS: 1460,
+	}
+	// probeHeader is the header of the generated stealth probes.
+	probeHeader := &SYNHeader{IPID: 1, TTL: 64, Window: 1024, Seq: 1000}
 	testCases := []struct {
 		desc              string
 		packetCapturePath string
+		cfg               captureConfig
 		want              []*Connection
 		closeErr          error
 		wantErr           bool
@@ -31,6 +50,8 @@ func TestParse(t *testing.T) {
 						IP:   net.ParseIP("192.168.86.191"),
 						Port: 1992,
 					},
+					Header: linuxHeader,
+					Time:   time.Unix(1624689612, 309495000),
 				},
 			},
 			wantErr: false,
@@ -50,6 +71,14 @@ func TestParse(t *testing.T) {
 						IP:   net.ParseIP("2406:da1c:4bb:9160:be8c:85d2:28db:4e29"),
 						Port: 22,
 					},
+					Header: &SYNHeader{
+						TTL:     255,
+						Window:  26823,
+						Seq:     1543559340,
+						Options: linuxHeader.Options,
+						MSS:     8941,
+					},
+					Time: time.Unix(1624711462, 666173000),
 				},
 			},
 			wantErr: false,
@@ -70,6 +99,8 @@ func TestParse(t *testing.T) {
 						IP:   net.ParseIP("192.168.86.191"),
 						Port: 1992,
 					},
+					Header: linuxHeader,
+					Time:   time.Unix(1624689612, 309495000),
 				},
 			},
 			wantErr: false,
@@ -90,6 +121,223 @@ func TestParse(t *testing.T) {
 			// tcpdump --direction=in -c 1 -s90 -n -X -i wlp3s0 "icmp and host 192.168.86.158" -w udp.pcap
 			packetCapturePath: "testdata/icmp.pcap",
 		},
+		{
+			desc: "test UDP is skipped unless captured",
+			// This was generated, and has an inbound UDP datagram followed by
+			// ICMP and ICMPv6 port unreachable replies.
+			packetCapturePath: "testdata/udp_scan.pcap",
+		},
+		{
+			desc:              "test UDP datagrams and port unreachable replies are parsed correctly",
+			packetCapturePath: "testdata/udp_scan.pcap",
+			cfg:               captureConfig{udp: true},
+			want: []*Connection{
+				{
+					Protocol: ProtocolUDP,
+					Src: &net.TCPAddr{
+						IP:   net.ParseIP("192.168.86.158"),
+						Port: 41000,
+					},
+					Dst: &net.TCPAddr{
+						IP:   net.ParseIP("192.168.86.191"),
+						Port: 161,
+					},
+					Time: time.Unix(1624689700, 0),
+				},
+				{
+					Protocol: ProtocolUDP,
+					Src: &net.TCPAddr{
+						IP:   net.ParseIP("192.168.86.158"),
+						Port: 41000,
+					},
+					Dst: &net.TCPAddr{
+						IP:   net.ParseIP("192.168.86.191"),
+						Port: 162,
+					},
+					Unreachable: true,
+					Time:        time.Unix(1624689701, 0),
+				},
+				{
+					Protocol: ProtocolUDP,
+					Src: &net.TCPAddr{
+						IP:   net.ParseIP("2406:da1c:4bb:9160:5662:60b0:37f6:186e"),
+						Port: 37920,
+					},
+					Dst: &net.TCPAddr{
+						IP:   net.ParseIP("2406:da1c:4bb:9160:be8c:85d2:28db:4e29"),
+						Port: 53,
+					},
+					Unreachable: true,
+					Time:        time.Unix(1624689702, 0),
+				},
+			},
+		},
+		{
+			desc: "test replies to the host's UDP datagrams are skipped",
+			// This was generated, and has DNS replies to four ephemeral
+			// ports, an NTP query from the host and its reply, and an
+			// inbound UDP datagram.
+			packetCapturePath: "testdata/udp_replies.pcap",
+			cfg:               captureConfig{udp: true},
+			want: []*Connection{
+				// Packet captures have no direction, so the host's own
+				// query is a connection from it.
+				{
+					Protocol: ProtocolUDP,
+					Src:      &net.TCPAddr{IP: net.ParseIP("192.168.86.191"), Port: 123},
+					Dst:      &net.TCPAddr{IP: net.ParseIP("162.159.200.1"), Port: 123},
+					Time:     time.Unix(1624689904, 0),
+				},
+				{
+					Protocol: ProtocolUDP,
+					Src:      &net.TCPAddr{IP: net.ParseIP("192.168.86.158"), Port: 41000},
+					Dst:      &net.TCPAddr{IP: net.ParseIP("192.168.86.191"), Port: 161},
+					Time:     time.Unix(1624689906, 0),
+				},
+			},
+		},
+		{
+			desc: "test stealth probes are skipped unless captured",
+			// This was generated, and has FIN, NULL and XMAS probes followed
+			// by a FIN + ACK, and an IPv6 XMAS probe.
+			packetCapturePath: "testdata/stealth.pcap",
+		},
+		{
+			desc:              "test stealth probes are parsed correctly",
+			packetCapturePath: "testdata/stealth.pcap",
+			cfg:               captureConfig{stealth: true},
+			want: []*Connection{
+				{
+					Src:     &net.TCPAddr{IP: net.ParseIP("192.168.86.158"), Port: 51000},
+					Dst:     &net.TCPAddr{IP: net.ParseIP("192.168.86.191"), Port: 21},
+					Stealth: ProbeFIN,
+					Header:  probeHeader,
+					Time:    time.Unix(1624689800, 0),
+				},
+				{
+					Src:     &net.TCPAddr{IP: net.ParseIP("192.168.86.158"), Port: 51000},
+					Dst:     &net.TCPAddr{IP: net.ParseIP("192.168.86.191"), Port: 22},
+					Stealth: ProbeNULL,
+					Header:  probeHeader,
+					Time:    time.Unix(1624689801, 0),
+				},
+				{
+					Src:     &net.TCPAddr{IP: net.ParseIP("192.168.86.158"), Port: 51000},
+					Dst:     &net.TCPAddr{IP: net.ParseIP("192.168.86.191"), Port: 23},
+					Stealth: ProbeXMAS,
+					Header:  probeHeader,
+					Time:    time.Unix(1624689802, 0),
+				},
+				{
+					Src:     &net.TCPAddr{IP: net.ParseIP("2406:da1c:4bb:9160:5662:60b0:37f6:186e"), Port: 37920},
+					Dst:     &net.TCPAddr{IP: net.ParseIP("2406:da1c:4bb:9160:be8c:85d2:28db:4e29"), Port: 22},
+					Stealth: ProbeXMAS,
+					Header:  &SYNHeader{TTL: 64, Window: 1024, Seq: 1000},
+					Time:    time.Unix(1624689804, 0),
+				},
+			},
+		},
+		{
+			desc:              "test ICMP echo request is parsed correctly",
+			packetCapturePath: "testdata/icmp.pcap",
+			cfg:               captureConfig{icmp: true},
+			want: []*Connection{
+				{
+					Protocol: ProtocolICMP,
+					Src:      &net.TCPAddr{IP: net.ParseIP("192.168.86.158")},
+					Dst:      &net.TCPAddr{IP: net.ParseIP("192.168.86.191")},
+					Time:     time.Unix(1624690700, 362839000),
+				},
+			},
+		},
+		{
+			desc: "test ICMP probes are parsed correctly",
+			// This was generated, and has an echo request and reply, an
+			// ICMPv6 echo request, and neighbour solicitations from an
+			// address and for duplicate address detection.
+			packetCapturePath: "testdata/ping.pcap",
+			cfg:               captureConfig{icmp: true},
+			want: []*Connection{
+				{
+					Protocol: ProtocolICMP,
+					Src:      &net.TCPAddr{IP: net.ParseIP("192.168.86.158")},
+					Dst:      &net.TCPAddr{IP: net.ParseIP("192.168.86.191")},
+					Time:     time.Unix(1624689900, 0),
+				},
+				{
+					Protocol: ProtocolICMP,
+					Src:      &net.TCPAddr{IP: net.ParseIP("2406:da1c:4bb:9160:5662:60b0:37f6:186e")},
+					Dst:      &net.TCPAddr{IP: net.ParseIP("2406:da1c:4bb:9160:be8c:85d2:28db:4e29")},
+					Time:     time.Unix(1624689902, 0),
+				},
+				{
+					Protocol:     ProtocolICMP,
+					Src:          &net.TCPAddr{IP: net.ParseIP("2406:da1c:4bb:9160:5662:60b0:37f6:186e")},
+					Dst:          &net.TCPAddr{IP: net.ParseIP("2406:da1c:4bb:9160:be8c:85d2:28db:4e29")},
+					Solicitation: true,
+					Time:         time.Unix(1624689903, 0),
+				},
+			},
+		},
+		{
+			desc: "test SCTP is skipped unless captured",
+			// This was generated, and has an SCTP INIT followed by a DATA
+			// chunk, and an SCTP INIT over IPv6.
+			packetCapturePath: "testdata/sctp.pcap",
+		},
+		{
+			desc:              "test SCTP INITs are parsed correctly",
+			packetCapturePath: "testdata/sctp.pcap",
+			cfg:               captureConfig{sctp: true},
+			want: []*Connection{
+				{
+					Protocol: ProtocolSCTP,
+					Src:      &net.TCPAddr{IP: net.ParseIP("192.168.86.158"), Port: 52000},
+					Dst:      &net.TCPAddr{IP: net.ParseIP("192.168.86.191"), Port: 2905},
+					Time:     time.Unix(1624690000, 0),
+				},
+				{
+					Protocol: ProtocolSCTP,
+					Src:      &net.TCPAddr{IP: net.ParseIP("2406:da1c:4bb:9160:5662:60b0:37f6:186e"), Port: 37920},
+					Dst:      &net.TCPAddr{IP: net.ParseIP("2406:da1c:4bb:9160:be8c:85d2:28db:4e29"), Port: 3868},
+					Time:     time.Unix(1624690002, 0),
+				},
+			},
+		},
+		{
+			desc: "test answers to SYNs are parsed correctly",
+			// This was generated, and has SYNs to 22, 3306, 6379, 8080 and
+			// 9200 answered with a SYN-ACK, a RST, a RST, nothing and a RST.
+			packetCapturePath: "testdata/unanswered.pcap",
+			cfg:               captureConfig{answers: true},
+			want: func() []*Connection {
+				src, dst := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+				start := time.Unix(1624690800, 0)
+				syn := func(seconds, port int) *Connection {
+					return &Connection{
+						Src:    &net.TCPAddr{IP: src, Port: 40000},
+						Dst:    &net.TCPAddr{IP: dst, Port: port},
+						Header: probeHeader,
+						Time:   start.Add(time.Duration(seconds) * time.Second),
+					}
+				}
+				answer := func(seconds, port int, r TCPReply) *Connection {
+					return &Connection{
+						Src:   &net.TCPAddr{IP: src, Port: 40000},
+						Dst:   &net.TCPAddr{IP: dst, Port: port},
+						Reply: r,
+						Time:  start.Add(time.Duration(seconds)*time.Second + time.Millisecond),
+					}
+				}
+				return []*Connection{
+					syn(0, 22), answer(0, 22, ReplySYNACK),
+					syn(1, 3306), answer(1, 3306, ReplyRST),
+					syn(2, 6379), answer(2, 6379, ReplyRST),
+					syn(3, 8080),
+					syn(6, 9200), answer(6, 9200, ReplyRST),
+				}
+			}(),
+		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
@@ -97,7 +345,7 @@ func TestParse(t *testing.T) {
 			if err != nil {
 				t.Errorf("os.Open(%s) returned err=%v,want err=%t", tC.packetCapturePath, err, tC.wantErr)
 			}
-			cptr, err := newCapturerOffline(file)
+			cptr, err := newCapturerOffline(file, tC.cfg)
 			if (err != nil) != tC.wantErr {
 				t.Errorf("newCapturerOffline() returned err=%v,want err=%t", err, tC.wantErr)
 			}
@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity is how confident a Detector is that a Detection is hostile.
+type Severity int
+
+const (
+	// SeverityInfo detections are only logged, their sources aren't blocked.
+	SeverityInfo Severity = iota
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityLow:
+		return "low"
+	case SeverityMedium:
+		return "medium"
+	case SeverityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Evidence is what a Detector found, such as a *TrackerEntry. Its String is
+// used when logging the Detection.
+type Evidence interface {
+	String() string
+}
+
+// Detection is raised by a Detector when it finds suspicious connections.
+type Detection struct {
+	// Detector is the Name of the Detector that raised this.
+	Detector string
+	// SrcIPs are the sources responsible, these are blocked unless Severity
+	// is SeverityInfo.
+	SrcIPs   []*net.IP
+	Evidence Evidence
+	Severity Severity
+	// FirstSeen and LastSeen are the times of the first and the most recent
+	// connection in the Evidence.
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Detector defines the contract for a strategy that detects port scans (or
+// anything else) from captured connections. Each connection is added to every
+// Detector, and their Detections are blocked by the Engine.
+type Detector interface {
+	// Name identifies the Detector in logs and metrics.
+	Name() string
+	Add(*Connection)
+	Detections() chan *Detection
+	// Close closes the Detections channel.
+	Close()
+}
+
+// emitter sends the Detections of a Detector. Detectors emit outside of their
+// own lock, so that expiry and Stats carry on while a Detection is received.
+type emitter struct {
+	c chan *Detection
+	// protects closed, and c from being closed while sending.
+	l      sync.RWMutex
+	closed bool
+}
+
+func newEmitter() *emitter {
+	return &emitter{c: make(chan *Detection)}
+}
+
+// emit sends d, unless the emitter is closed.
+func (em *emitter) emit(d *Detection) {
+	em.l.RLock()
+	defer em.l.RUnlock()
+	if !em.closed {
+		em.c <- d
+	}
+}
+
+// close closes the channel once any Detection being sent is received.
+func (em *emitter) close() {
+	em.l.Lock()
+	defer em.l.Unlock()
+	em.closed = true
+	close(em.c)
+}
+
+// onceTracker is the part of a Detector that detects a source from a single
+// connection, such as toolTracker, which detects each source at most once per
+// window. The Detector provides Name and Add, and emits what Add detects.
+type onceTracker struct {
+	detections *emitter
+	window     time.Duration
+	// packetClock tells time by the connections that are added rather than
+	// the wall clock, see Tracker.
+	packetClock bool
+	done        chan struct{}
+	// protects everything below.
+	l sync.Mutex
+	// reported is when each source was last detected, for each protocol.
+	reported map[string]time.Time
+	latest   time.Time
+}
+
+// newOnceTracker takes the window a source is detected at most once within
+// and returns an instance of onceTracker.
+func newOnceTracker(window, evaluationInterval time.Duration) (t *onceTracker) {
+	t = &onceTracker{
+		detections: newEmitter(),
+		window:     window,
+		done:       make(chan struct{}),
+		reported:   make(map[string]time.Time),
+	}
+	go func() {
+		tick := time.NewTicker(evaluationInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-t.done:
+				return
+			}
+			t.l.Lock()
+			now := t.now()
+			for k, v := range t.reported {
+				if now.Sub(v) >= t.window {
+					delete(t.reported, k)
+				}
+			}
+			t.l.Unlock()
+		}
+	}()
+	return
+}
+
+// now returns the wall clock, or the time of the most recent connection when
+// packetClock is set. The caller must hold t.l.
+func (t *onceTracker) now() time.Time {
+	if t.packetClock {
+		return t.latest
+	}
+	return time.Now()
+}
+
+// report records that the source of v is detected and returns when, or false
+// if it was already detected over the same protocol within the window.
+func (t *onceTracker) report(v *Connection) (time.Time, bool) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.packetClock && v.Time.After(t.latest) {
+		t.latest = v.Time
+	}
+	now := t.now()
+	k := v.Protocol.String() + " " + v.Src.IP.String()
+	if r, ok := t.reported[k]; ok && now.Sub(r) < t.window {
+		return now, false
+	}
+	t.reported[k] = now
+	return now, true
+}
+
+// Detections returns a channel that callers can retrieve the Detections from.
+func (t *onceTracker) Detections() chan *Detection {
+	return t.detections.c
+}
+
+// Close stops expiring sources, and closes the Detections channel.
+func (t *onceTracker) Close() {
+	close(t.done)
+	t.detections.close()
+}
+
+// connectionCounter is implemented by Detectors that track connections, see
+// Tracker.Connections.
+type connectionCounter interface {
+	Connections() int
+}
+
+// ipList returns ips as a comma separated string.
+func ipList(ips []*net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ",")
+}
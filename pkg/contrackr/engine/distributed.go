@@ -0,0 +1,224 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// DistributedScan is many sources that each connected to unusual ports within
+// the window, such as a botnet splitting a port scan between its members so
+// that none of them scan enough ports to be noticed alone.
+type DistributedScan struct {
+	// SrcIPs are the participating sources, in the order they were first
+	// seen.
+	SrcIPs []*net.IP
+	// Ports are the distinct ports connected to, in ascending order.
+	Ports     []int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// String returns the sources and ports of s.
+func (s *DistributedScan) String() string {
+	return fmt.Sprintf("%d sources (%s) on ports %v", len(s.SrcIPs), ipList(s.SrcIPs), s.Ports)
+}
+
+// maxParticipantPorts caps how many of the ports each source connected to are
+// remembered. Only the number of sources is detected on, the ports are just
+// evidence.
+const maxParticipantPorts = 64
+
+// participant is a source taking part in a possible distributed scan.
+type participant struct {
+	ip *net.IP
+	// ports are up to maxPorts of the ports the source connected to.
+	ports map[int]bool
+	first time.Time
+	last  time.Time
+}
+
+// distributedTracker is the Detector for distributed port scans, where more
+// than threshold distinct sources connect to ports other than the
+// servicePorts, and those the host is listening on, within the window.
+type distributedTracker struct {
+	detections *emitter
+	// severity is SeverityInfo unless the participants should be blocked.
+	severity     Severity
+	threshold    int
+	window       time.Duration
+	servicePorts map[int]bool
+	// maxPorts is how many ports each participant remembers, it's
+	// maxParticipantPorts outside of tests.
+	maxPorts int
+	// listening are the ports the host is listening on, which aren't
+	// unusual either. It may be nil.
+	listening *listeningPorts
+	// packetClock tells time by the connections that are added rather than
+	// the wall clock, see Tracker.
+	packetClock bool
+	done        chan struct{}
+	// protects everything below.
+	l sync.Mutex
+	m map[string]*participant
+	// order is the keys of m in the order they were first seen.
+	order  []string
+	latest time.Time
+}
+
+// newDistributedTracker takes the window sources are correlated within, how
+// many distinct sources may connect to unusual ports within it, the ports
+// that are expected to be connected to, and whether participants should be
+// blocked and returns an instance of distributedTracker.
+func newDistributedTracker(window, evaluationInterval time.Duration, threshold int, servicePorts []int, block bool) (t *distributedTracker) {
+	t = &distributedTracker{
+		detections:   newEmitter(),
+		severity:     SeverityInfo,
+		threshold:    threshold,
+		window:       window,
+		servicePorts: make(map[int]bool),
+		maxPorts:     maxParticipantPorts,
+		done:         make(chan struct{}),
+		m:            make(map[string]*participant),
+	}
+	if block {
+		t.severity = SeverityMedium
+	}
+	for _, p := range servicePorts {
+		t.servicePorts[p] = true
+	}
+	go func() {
+		tick := time.NewTicker(evaluationInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-t.done:
+				return
+			}
+			t.l.Lock()
+			t.expire(t.now())
+			t.l.Unlock()
+		}
+	}()
+	return
+}
+
+// now returns the wall clock, or the time of the most recent connection when
+// packetClock is set. The caller must hold t.l.
+func (t *distributedTracker) now() time.Time {
+	if t.packetClock {
+		return t.latest
+	}
+	return time.Now()
+}
+
+// expire forgets the sources that haven't connected within the window. The
+// caller must hold t.l.
+func (t *distributedTracker) expire(now time.Time) {
+	order := t.order[:0]
+	for _, k := range t.order {
+		if now.Sub(t.m[k].last) > t.window {
+			delete(t.m, k)
+			continue
+		}
+		order = append(order, k)
+	}
+	t.order = order
+}
+
+// Add adds the connection v into the tracker, connections to service ports
+// and listening ports (and ICMP probes, and the host's answers to SYNs) are
+// ignored.
+func (t *distributedTracker) Add(v *Connection) {
+	if !v.Protocol.hasPorts() || v.Reply != ReplyNone || t.servicePorts[v.Dst.Port] {
+		return
+	}
+	if t.listening.has(v.Protocol, v.Dst.IP, v.Dst.Port) {
+		return
+	}
+	t.l.Lock()
+	if t.packetClock && v.Time.After(t.latest) {
+		t.latest = v.Time
+	}
+	now := t.now()
+	k := v.Src.IP.String()
+	p, ok := t.m[k]
+	if !ok {
+		p = &participant{ip: &v.Src.IP, ports: make(map[int]bool), first: now}
+		t.m[k] = p
+		t.order = append(t.order, k)
+	}
+	if len(p.ports) < t.maxPorts {
+		p.ports[v.Dst.Port] = true
+	}
+	p.last = now
+	if len(t.m) <= t.threshold {
+		t.l.Unlock()
+		return
+	}
+	log.V(2).Infof("%d sources connected to unusual ports within %v", len(t.m), t.window)
+	scan := t.scan()
+	// Start afresh, so that a large scan is reported as it continues.
+	t.m = make(map[string]*participant)
+	t.order = nil
+	t.l.Unlock()
+	t.detections.emit(&Detection{
+		Detector:  t.Name(),
+		SrcIPs:    scan.SrcIPs,
+		Evidence:  scan,
+		Severity:  t.severity,
+		FirstSeen: scan.FirstSeen,
+		LastSeen:  scan.LastSeen,
+	})
+}
+
+// scan returns the DistributedScan made by every tracked source. The caller
+// must hold t.l.
+func (t *distributedTracker) scan() *DistributedScan {
+	s := &DistributedScan{}
+	ports := make(map[int]bool)
+	for i, k := range t.order {
+		p := t.m[k]
+		s.SrcIPs = append(s.SrcIPs, p.ip)
+		for port := range p.ports {
+			if !ports[port] {
+				ports[port] = true
+				s.Ports = append(s.Ports, port)
+			}
+		}
+		if i == 0 || p.first.Before(s.FirstSeen) {
+			s.FirstSeen = p.first
+		}
+		if p.last.After(s.LastSeen) {
+			s.LastSeen = p.last
+		}
+	}
+	sort.Ints(s.Ports)
+	return s
+}
+
+// Name returns the name of the distributedTracker's detections.
+func (t *distributedTracker) Name() string {
+	return "distributed scan"
+}
+
+// Detections returns a channel that callers can retrieve distributed port
+// scans from, the Evidence is a *DistributedScan.
+func (t *distributedTracker) Detections() chan *Detection {
+	return t.detections.c
+}
+
+// Close stops expiring sources and refreshing the listening ports, and closes
+// the Detections channel.
+func (t *distributedTracker) Close() {
+	close(t.done)
+	if t.listening != nil {
+		t.listening.Close()
+	}
+	t.detections.close()
+}
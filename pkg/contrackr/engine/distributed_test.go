@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// expiringDistributedTracker expires sources before each connection is
+// added, as the ticker would between them.
+type expiringDistributedTracker struct {
+	*distributedTracker
+}
+
+func (t expiringDistributedTracker) Add(c *Connection) {
+	t.l.Lock()
+	if c.Time.After(t.latest) {
+		t.latest = c.Time
+	}
+	t.expire(t.now())
+	t.l.Unlock()
+	t.distributedTracker.Add(c)
+}
+
+func TestDistributedTracker(t *testing.T) {
+	dstIP := net.ParseIP("192.168.86.191")
+	// sources is the network that connections come from.
+	const sources = "10.0.0"
+	// from returns a Connection from sources.<n> to port.
+	from := func(n, port int) *Connection {
+		return conn(host(sources, n), dstIP, port)
+	}
+	testCases := []struct {
+		desc string
+		// listening reads the ports the host is listening on from
+		// testdata/proc_net.
+		listening bool
+		// maxPorts overrides maxParticipantPorts when set.
+		maxPorts int
+		in       []*Connection
+		want     []*DistributedScan
+	}{
+		{
+			desc: "test many sources scanning a port each are detected",
+			in:   []*Connection{at(0, from(1, 22)), at(5, from(2, 3306)), at(10, from(3, 23)), at(10, from(1, 3389)), at(15, from(4, 22))},
+			want: []*DistributedScan{
+				{
+					SrcIPs:    ips(sources, 1, 2, 3, 4),
+					Ports:     []int{22, 23, 3306, 3389},
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(15 * time.Second),
+				},
+			},
+		},
+		{
+			desc: "test connections to service ports are ignored",
+			in:   []*Connection{at(0, from(1, 22)), at(5, from(2, 443)), at(10, from(3, 80)), at(15, from(4, 22))},
+		},
+		{
+			desc:      "test connections to listening ports are ignored",
+			listening: true,
+			in:        []*Connection{at(0, from(1, 22)), at(5, from(2, 3306)), at(10, from(3, 22)), at(15, from(4, 23))},
+		},
+		{
+			desc:     "test the ports each source remembers are capped",
+			maxPorts: 2,
+			in:       []*Connection{at(0, from(1, 22)), at(1, from(1, 23)), at(2, from(1, 25)), at(3, from(2, 22)), at(4, from(3, 22)), at(5, from(4, 22))},
+			want: []*DistributedScan{
+				{
+					SrcIPs:    ips(sources, 1, 2, 3, 4),
+					Ports:     []int{22, 23},
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(5 * time.Second),
+				},
+			},
+		},
+		{
+			desc: "test sources spread wider than the window aren't detected",
+			in:   []*Connection{at(0, from(1, 22)), at(20, from(2, 22)), at(40, from(3, 22)), at(60, from(4, 22))},
+		},
+		{
+			desc: "test a continuing scan is reported again",
+			in: []*Connection{
+				at(0, from(1, 22)), at(1, from(2, 22)), at(2, from(3, 22)), at(3, from(4, 22)),
+				at(4, from(5, 22)), at(5, from(6, 22)), at(6, from(7, 22)), at(7, from(8, 22)),
+			},
+			want: []*DistributedScan{
+				{
+					SrcIPs:    ips(sources, 1, 2, 3, 4),
+					Ports:     []int{22},
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(3 * time.Second),
+				},
+				{
+					SrcIPs:    ips(sources, 5, 6, 7, 8),
+					Ports:     []int{22},
+					FirstSeen: epoch.Add(4 * time.Second),
+					LastSeen:  epoch.Add(7 * time.Second),
+				},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tkr := newDistributedTracker(30*time.Second, time.Hour, 3, []int{80, 443}, false)
+			tkr.packetClock = true
+			if tC.listening {
+				tkr.listening = newListeningPorts("testdata/proc_net", time.Hour)
+			}
+			if tC.maxPorts > 0 {
+				tkr.maxPorts = tC.maxPorts
+			}
+			var got []*DistributedScan
+			for _, d := range collect(expiringDistributedTracker{tkr}, tC.in) {
+				got = append(got, d.Evidence.(*DistributedScan))
+			}
+			if diff := cmp.Diff(tC.want, got); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package engine
+
+import (
+	"net"
+
+	log "github.com/golang/glog"
+)
+
+// dryRunBlocker implements the BlockCloser interface without touching the host
+// firewall, it only logs the decisions that would have been made. The engine
+// still keeps track of these would-be blocks, so they show up in Stats.
+type dryRunBlocker struct{}
+
+// Block logs that v would have been blocked, it always returns a nil error.
+func (dryRunBlocker) Block(v *net.IP) error {
+	log.Infof("dry-run: would block %s", v)
+	return nil
+}
+
+// Unblock logs that v would have been unblocked, it always returns a nil error.
+func (dryRunBlocker) Unblock(v *net.IP) error {
+	log.Infof("dry-run: would unblock %s", v)
+	return nil
+}
+
+// Close always returns nil.
+func (dryRunBlocker) Close() error {
+	return nil
+}
@@ -3,21 +3,26 @@ package engine
 import (
 	"fmt"
 	"net"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	log "github.com/golang/glog"
 )
 
-const (
-	minimumPortScanned = 3
-	// how long do entries get tracked for.
-	trackerEntryTTL = 1 * time.Minute
-	// how often do we evaluate our entries (ideally more often than entry TTL)
-	evaluationInterval = 1 * time.Second
-)
-
 type Stats struct {
 	TotalConnections int
+	// Blocks are the currently blocked IPs and when they will be unblocked.
+	Blocks []Block
+	// AllowlistHits is how many port scans were detected from allowlisted
+	// source IPs, and so weren't blocked.
+	AllowlistHits int
+	// TotalBlocks is how many times a source IP has been blocked.
+	TotalBlocks int
+	// Detections is how many Detections each Detector has raised, by name.
+	Detections map[string]int
+	// DryRun is true when the firewall isn't being touched, Blocks and
+	// TotalBlocks are what would have been blocked.
+	DryRun bool
 }
 
 // CaptureCloser defines the contract for capturing packets from an interface.
@@ -26,82 +31,209 @@ type CaptureCloser interface {
 	Close() error
 }
 
-// BlockCloser defines the contract for blocking IP addresses on the host.
+// BlockCloser defines the contract for blocking (and unblocking) IP addresses
+// on the host.
 type BlockCloser interface {
 	Block(*net.IP) error
+	Unblock(*net.IP) error
 	Close() error
 }
 
-// Adder defines the contract for adding new connections to the tracker, and
-// retrieving those that are considered port scanners.
-type Adder interface {
-	Add(*Connection)
-	PortScanners() chan *TrackerEntry
-	Connections() int
-	Close()
+// Firewall is the name of a BlockCloser implementation.
+type Firewall string
+
+const (
+	// FirewallIPTables blocks with iptables(8), see Blocker.
+	FirewallIPTables Firewall = "iptables"
+	// FirewallNFTables blocks with nft(8), see NFTBlocker.
+	FirewallNFTables Firewall = "nftables"
+	// FirewallIPSet blocks with iptables(8) matching against ipset(8) sets,
+	// this scales far better than FirewallIPTables with many blocked IPs.
+	FirewallIPSet Firewall = "ipset"
+)
+
+// newFirewall returns the BlockCloser for f, else error.
+func newFirewall(f Firewall) (BlockCloser, error) {
+	switch f {
+	case FirewallIPTables:
+		return newBlocker()
+	case FirewallNFTables:
+		return newNFTBlocker()
+	case FirewallIPSet:
+		return newIPSetBlocker()
+	}
+	return nil, fmt.Errorf("unknown firewall %q", f)
 }
 
-// Engine contains the methods for running the connection tracker and blocker.
+// Engine contains the methods for running the detectors and blocker.
 type Engine struct {
-	capturer CaptureCloser
-	firewall BlockCloser
-	tracker  Adder
+	capturer  CaptureCloser
+	firewall  BlockCloser
+	blocks    *blocklist
+	allowlist allowlist
+	detectors []Detector
+	dryRun    bool
+
+	allowlistHits int64 // accessed atomically.
+	// protects detections and handled.
+	l sync.Mutex
+	// detections is how many Detections each Detector raised.
+	detections map[string]int
+	// handled is closed once Run has handled every Detection, it's nil until
+	// Run is called.
+	handled chan struct{}
 }
 
-// New accepts a deviceName (eg. eth0) and returns an instance of Engine, else
-// error.
-func New(deviceName string) (*Engine, error) {
-	cap, err := newCapturer(deviceName)
+// New accepts a deviceName (eg. eth0) and any options, and returns an
+// instance of Engine, else error.
+func New(deviceName string, opts ...Option) (*Engine, error) {
+	o, err := newOptions(opts)
 	if err != nil {
 		return nil, err
 	}
-	fw, err := newBlocker()
+	cap, err := newCapturer(deviceName, o.capture())
 	if err != nil {
 		return nil, err
 	}
+	e, err := newEngine(cap, o, newFirewall)
+	if err != nil {
+		cap.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// newEngine returns an Engine configured by o, that reads from cap and blocks
+// with the firewall returned by open. On a dry run open is never called.
+func newEngine(cap CaptureCloser, o *options, open func(Firewall) (BlockCloser, error)) (*Engine, error) {
+	var fw BlockCloser = dryRunBlocker{}
+	if !o.dryRun {
+		var err error
+		if fw, err = open(o.firewall); err != nil {
+			return nil, err
+		}
+	}
 	return &Engine{
-		capturer: cap,
-		firewall: fw,
-		tracker:  newTracker(trackerEntryTTL, evaluationInterval, minimumPortScanned),
+		capturer:  cap,
+		firewall:  fw,
+		blocks:    o.blocklist(fw),
+		allowlist: o.allowlist,
+		detectors: o.newDetectors(false),
+		dryRun:    o.dryRun,
 	}, nil
 }
 
+// pendingDetections is how many Detections can wait on a slow firewall before
+// capture stalls.
+const pendingDetections = 1024
+
 // Run will monitor and block source IPs that attempt to port scan on the device.
+// It returns once Close has been called, and every Detection has been handled.
 func (e *Engine) Run() {
-	go func() {
-		for v := range e.tracker.PortScanners() {
-			var ports []int
-			for k := range v.Ports {
-				ports = append(ports, k)
+	handled := make(chan struct{})
+	e.l.Lock()
+	e.handled = handled
+	e.l.Unlock()
+	defer close(handled)
+	pending := make(chan *Detection, pendingDetections)
+	var wg sync.WaitGroup
+	for _, d := range e.detectors {
+		wg.Add(1)
+		go func(d Detector) {
+			defer wg.Done()
+			for v := range d.Detections() {
+				pending <- v
 			}
-			log.Infof("Port scan detected: %s -> %s on ports %v", v.SrcIP, v.DstIP, ports)
-			e.firewall.Block(v.SrcIP)
+		}(d)
+	}
+	go func() {
+		wg.Wait()
+		close(pending)
+	}()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for v := range pending {
+			e.handle(v)
 		}
 	}()
 	for pkt := range e.capturer.Capture() {
 		log.Infof("New connection: %v -> %v", pkt.Src, pkt.Dst)
-		e.tracker.Add(pkt)
+		for _, d := range e.detectors {
+			d.Add(pkt)
+		}
+	}
+	// pending is closed once Close has closed every Detector.
+	<-drained
+}
+
+// handle logs the Detection v, and blocks its sources unless it's only
+// informational.
+func (e *Engine) handle(v *Detection) {
+	log.Infof("Detected %s (%s severity): %s", v.Detector, v.Severity, v.Evidence)
+	e.l.Lock()
+	if e.detections == nil {
+		e.detections = make(map[string]int)
+	}
+	e.detections[v.Detector]++
+	e.l.Unlock()
+	if v.Severity == SeverityInfo {
+		return
+	}
+	for _, src := range v.SrcIPs {
+		if e.allowlist.Contains(src) {
+			log.Infof("%s is allowlisted, would have blocked", src)
+			atomic.AddInt64(&e.allowlistHits, 1)
+			continue
+		}
+		if err := e.blocks.Block(src); err != nil {
+			log.Warningf("unable to block %s: %v", src, err)
+		}
 	}
 }
 
 // Stats returns key metrics about the current running engine.
 func (e *Engine) Stats() *Stats {
-	// TODO(michaelmcallister): implement additional stats
-	// eg: number of IPs blocked
-	return &Stats{
-		TotalConnections: e.tracker.Connections(),
+	st := &Stats{
+		Blocks:        e.blocks.Blocks(),
+		AllowlistHits: int(atomic.LoadInt64(&e.allowlistHits)),
+		TotalBlocks:   e.blocks.Total(),
+		Detections:    make(map[string]int),
+		DryRun:        e.dryRun,
+	}
+	for _, d := range e.detectors {
+		if c, ok := d.(connectionCounter); ok {
+			st.TotalConnections += c.Connections()
+		}
+	}
+	e.l.Lock()
+	for k, v := range e.detections {
+		st.Detections[k] = v
 	}
+	e.l.Unlock()
+	return st
 }
 
-// Close cleans up any dependencies.
+// Close cleans up any dependencies. Capture is stopped and the Detections that
+// are still pending are handled before the blocklist and firewall are closed,
+// so that no IP is blocked after the firewall is cleaned up.
 func (e *Engine) Close() error {
 	var closeErr error
 	if err := e.capturer.Close(); err != nil {
 		closeErr = fmt.Errorf("capturer %v: %w", err, closeErr)
 	}
+	for _, d := range e.detectors {
+		d.Close()
+	}
+	e.l.Lock()
+	handled := e.handled
+	e.l.Unlock()
+	if handled != nil {
+		<-handled
+	}
+	e.blocks.Close()
 	if err := e.firewall.Close(); err != nil {
 		closeErr = fmt.Errorf("firewall %v", err)
 	}
-	e.tracker.Close()
 	return closeErr
 }
@@ -1,53 +1,68 @@
 package engine
 
 import (
+	"fmt"
 	"net"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 // fakeBlocker implements the BlockCloser interface.
 type fakeBlocker struct {
 	blockCalled chan bool
+	blocked     []string
 }
 
 // Block will track whether it has been called, returning a nil error always.
-func (fb *fakeBlocker) Block(_ *net.IP) error {
+func (fb *fakeBlocker) Block(v *net.IP) error {
+	fb.blocked = append(fb.blocked, v.String())
 	fb.blockCalled <- true
 	return nil
 }
 
+// Unblock always returns nil.
+func (fb *fakeBlocker) Unblock(_ *net.IP) error {
+	return nil
+}
+
 // Close always returns nil.
 func (fb *fakeBlocker) Close() error {
 	return nil
 }
 
-// fakeTracker implements the Adder interface.
-type fakeTracker struct {
+// fakeDetector implements the Detector interface.
+type fakeDetector struct {
 	tracking int
-	tc       chan *TrackerEntry
+	dc       chan *Detection
 }
 
-// Add is a no-op.
-func (ft *fakeTracker) Add(_ *Connection) {
-	ft.tracking++
+// Name returns "fake".
+func (fd *fakeDetector) Name() string {
+	return "fake"
 }
 
-// PortScanners returns the channel that callers can recieve as soon as a
-// "port scanner" is identified.
-func (ft *fakeTracker) PortScanners() chan *TrackerEntry {
-	return ft.tc
+// Add counts the connections added.
+func (fd *fakeDetector) Add(_ *Connection) {
+	fd.tracking++
 }
 
-// Count returns how many connections are being tracked. This instance tracks
-// them forever, until manually cleared.
-func (ft *fakeTracker) Connections() int {
-	return ft.tracking
+// Detections returns the channel that callers can recieve as soon as
+// something is detected.
+func (fd *fakeDetector) Detections() chan *Detection {
+	return fd.dc
+}
+
+// Connections returns how many connections have been added.
+func (fd *fakeDetector) Connections() int {
+	return fd.tracking
 }
 
 // Close closes the underlying channel.
-func (ft *fakeTracker) Close() {
-	close(ft.tc)
+func (fd *fakeDetector) Close() {
+	close(fd.dc)
 }
 
 // fakeCapturer implements the CaptureCloser interface.
@@ -68,13 +83,14 @@ func (fc *fakeCapturer) Close() error {
 }
 
 func TestEngineBlocksPortScans(t *testing.T) {
-	// Entries added to this channel are considered "port scanners"
-	portscanners := make(chan *TrackerEntry)
+	// Detections added to this channel are blocked.
+	detections := make(chan *Detection)
 	fakeBlocker := &fakeBlocker{blockCalled: make(chan bool)}
 	fakeEngine := &Engine{
-		capturer: &fakeCapturer{captureChan: make(chan *Connection)},
-		firewall: fakeBlocker,
-		tracker:  &fakeTracker{tc: portscanners},
+		capturer:  &fakeCapturer{captureChan: make(chan *Connection)},
+		firewall:  fakeBlocker,
+		blocks:    newBlocklist(fakeBlocker, []time.Duration{time.Hour}, time.Second),
+		detectors: []Detector{&fakeDetector{dc: detections}},
 	}
 	var wg sync.WaitGroup
 
@@ -85,12 +101,20 @@ func TestEngineBlocksPortScans(t *testing.T) {
 		fakeEngine.Run()
 	}()
 
-	// Send an entry to the portscanner channel.
+	// Send a port scan to the detections channel.
 	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
-	portscanners <- &TrackerEntry{
-		DstIP: &srcIP,
-		SrcIP: &dstIP,
-		Ports: map[int]int{1992: 1, 7: 1, 9: 1},
+	detections <- &Detection{
+		Detector: "fake",
+		SrcIPs:   []*net.IP{&srcIP},
+		Evidence: &TrackerEntry{
+			Kind:   KindPortScan,
+			DstIP:  &dstIP,
+			SrcIP:  &srcIP,
+			DstIPs: []*net.IP{&dstIP},
+			SrcIPs: []*net.IP{&srcIP},
+			Ports:  map[int]int{1992: 1, 7: 1, 9: 1},
+		},
+		Severity: SeverityHigh,
 	}
 
 	ok := <-fakeBlocker.blockCalled
@@ -104,3 +128,283 @@ func TestEngineBlocksPortScans(t *testing.T) {
 		t.Errorf("Expected Block() method to be called but wasn't")
 	}
 }
+
+func TestEngineSkipsAllowlisted(t *testing.T) {
+	detections := make(chan *Detection)
+	fakeBlocker := &fakeBlocker{blockCalled: make(chan bool)}
+	allowed, err := ParseCIDRs("192.168.86.0/24")
+	if err != nil {
+		t.Fatalf("ParseCIDRs() = %v, want nil error", err)
+	}
+	fakeEngine := &Engine{
+		capturer:  &fakeCapturer{captureChan: make(chan *Connection)},
+		firewall:  fakeBlocker,
+		blocks:    newBlocklist(fakeBlocker, []time.Duration{time.Hour}, time.Second),
+		allowlist: allowed,
+		detectors: []Detector{&fakeDetector{dc: detections}},
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fakeEngine.Run()
+	}()
+
+	dstIP := net.ParseIP("192.168.86.191")
+	for _, src := range []string{"192.168.86.158", "10.0.0.1"} {
+		srcIP := net.ParseIP(src)
+		detections <- &Detection{
+			Detector: "fake",
+			SrcIPs:   []*net.IP{&srcIP},
+			Evidence: &TrackerEntry{
+				Kind:   KindPortScan,
+				DstIP:  &dstIP,
+				SrcIP:  &srcIP,
+				DstIPs: []*net.IP{&dstIP},
+				SrcIPs: []*net.IP{&srcIP},
+				Ports:  map[int]int{1992: 1, 7: 1, 9: 1, 80: 1},
+			},
+			Severity: SeverityHigh,
+		}
+	}
+	// Entries are handled in order, so the allowlisted entry has been handled
+	// once the second is blocked.
+	<-fakeBlocker.blockCalled
+	hits := fakeEngine.Stats().AllowlistHits
+	fakeEngine.Close()
+	wg.Wait()
+
+	if diff := cmp.Diff([]string{"10.0.0.1"}, fakeBlocker.blocked); diff != "" {
+		t.Errorf("Block() mismatch (-want +got):\n%s", diff)
+	}
+	if hits != 1 {
+		t.Errorf("Stats().AllowlistHits = %d, want 1", hits)
+	}
+}
+
+func TestEngineBlocksSlowScans(t *testing.T) {
+	captured := make(chan *Connection)
+	fakeBlocker := &fakeBlocker{blockCalled: make(chan bool)}
+	fakeEngine := &Engine{
+		capturer:  &fakeCapturer{captureChan: captured},
+		firewall:  fakeBlocker,
+		blocks:    newBlocklist(fakeBlocker, []time.Duration{time.Hour}, time.Second),
+		detectors: []Detector{newSlowTracker(time.Hour, time.Second, 2, 32, 128)},
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fakeEngine.Run()
+	}()
+
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	for _, port := range []int{22, 80, 443} {
+		captured <- conn(srcIP, dstIP, port)
+	}
+	<-fakeBlocker.blockCalled
+	fakeEngine.Close()
+	wg.Wait()
+
+	if diff := cmp.Diff([]string{"192.168.86.158"}, fakeBlocker.blocked); diff != "" {
+		t.Errorf("Block() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestEngineBlocksDistributedScans(t *testing.T) {
+	captured := make(chan *Connection)
+	fakeBlocker := &fakeBlocker{blockCalled: make(chan bool)}
+	fakeEngine := &Engine{
+		capturer:  &fakeCapturer{captureChan: captured},
+		firewall:  fakeBlocker,
+		blocks:    newBlocklist(fakeBlocker, []time.Duration{time.Hour}, time.Second),
+		detectors: []Detector{newDistributedTracker(time.Minute, time.Second, 1, nil, true)},
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fakeEngine.Run()
+	}()
+
+	dstIP := net.ParseIP("192.168.86.191")
+	for _, src := range []string{"10.0.0.1", "10.0.0.2"} {
+		captured <- conn(net.ParseIP(src), dstIP, 22)
+	}
+	<-fakeBlocker.blockCalled
+	<-fakeBlocker.blockCalled
+	scans := fakeEngine.Stats().Detections["distributed scan"]
+	fakeEngine.Close()
+	wg.Wait()
+
+	if diff := cmp.Diff([]string{"10.0.0.1", "10.0.0.2"}, fakeBlocker.blocked); diff != "" {
+		t.Errorf("Block() mismatch (-want +got):\n%s", diff)
+	}
+	if scans != 1 {
+		t.Errorf("Stats().Detections[distributed scan] = %d, want 1", scans)
+	}
+}
+
+func TestEngineOnlyLogsInfoDetections(t *testing.T) {
+	detections := make(chan *Detection)
+	fakeBlocker := &fakeBlocker{blockCalled: make(chan bool)}
+	fakeEngine := &Engine{
+		capturer:  &fakeCapturer{captureChan: make(chan *Connection)},
+		firewall:  fakeBlocker,
+		blocks:    newBlocklist(fakeBlocker, []time.Duration{time.Hour}, time.Second),
+		detectors: []Detector{&fakeDetector{dc: detections}},
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fakeEngine.Run()
+	}()
+
+	for _, d := range []struct {
+		src      string
+		severity Severity
+	}{
+		{src: "10.0.0.2", severity: SeverityInfo},
+		{src: "10.0.0.1", severity: SeverityLow},
+	} {
+		srcIP := net.ParseIP(d.src)
+		detections <- &Detection{
+			Detector: "fake",
+			SrcIPs:   []*net.IP{&srcIP},
+			Evidence: &DistributedScan{SrcIPs: []*net.IP{&srcIP}},
+			Severity: d.severity,
+		}
+	}
+	// Detections are handled in order, so the informational one has been
+	// handled once the second is blocked.
+	<-fakeBlocker.blockCalled
+	detected := fakeEngine.Stats().Detections["fake"]
+	fakeEngine.Close()
+	wg.Wait()
+
+	if diff := cmp.Diff([]string{"10.0.0.1"}, fakeBlocker.blocked); diff != "" {
+		t.Errorf("Block() mismatch (-want +got):\n%s", diff)
+	}
+	if detected != 2 {
+		t.Errorf("Stats().Detections[fake] = %d, want 2", detected)
+	}
+}
+
+// closingBlocker implements the BlockCloser interface, keeping a list of every
+// IP blocked before and after it was closed.
+type closingBlocker struct {
+	l                   sync.Mutex
+	closed              bool
+	blocked, lateBlocks []string
+}
+
+func (cb *closingBlocker) Block(v *net.IP) error {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+	if cb.closed {
+		cb.lateBlocks = append(cb.lateBlocks, v.String())
+		return nil
+	}
+	cb.blocked = append(cb.blocked, v.String())
+	return nil
+}
+
+func (cb *closingBlocker) Unblock(_ *net.IP) error {
+	return nil
+}
+
+func (cb *closingBlocker) Close() error {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+	cb.closed = true
+	return nil
+}
+
+func TestEngineHandlesPendingDetectionsOnClose(t *testing.T) {
+	srcIPs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	// The Detections are already waiting when the engine is closed.
+	detections := make(chan *Detection, len(srcIPs))
+	for _, src := range srcIPs {
+		srcIP := net.ParseIP(src)
+		detections <- &Detection{
+			Detector: "fake",
+			SrcIPs:   []*net.IP{&srcIP},
+			Evidence: &DistributedScan{SrcIPs: []*net.IP{&srcIP}},
+			Severity: SeverityHigh,
+		}
+	}
+	captured := make(chan *Connection)
+	fw := &closingBlocker{}
+	fakeEngine := &Engine{
+		capturer:  &fakeCapturer{captureChan: captured},
+		firewall:  fw,
+		blocks:    newBlocklist(fw, []time.Duration{time.Hour}, time.Second),
+		detectors: []Detector{&fakeDetector{dc: detections}},
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fakeEngine.Run()
+	}()
+
+	// Run is capturing once a connection is received.
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	captured <- conn(srcIP, dstIP, 22)
+	fakeEngine.Close()
+	wg.Wait()
+
+	if diff := cmp.Diff(srcIPs, fw.blocked); diff != "" {
+		t.Errorf("Block() mismatch (-want +got):\n%s", diff)
+	}
+	if len(fw.lateBlocks) > 0 {
+		t.Errorf("Block() called after Close() with %v", fw.lateBlocks)
+	}
+}
+
+func TestEngineDryRun(t *testing.T) {
+	o, err := newOptions([]Option{WithDryRun(), WithMinimumPortScanned(1)})
+	if err != nil {
+		t.Fatalf("newOptions() = %v, want nil error", err)
+	}
+	captured := make(chan *Connection)
+	fakeEngine, err := newEngine(&fakeCapturer{captureChan: captured}, o, func(f Firewall) (BlockCloser, error) {
+		t.Errorf("opened the %s firewall on a dry run", f)
+		return nil, fmt.Errorf("unexpected firewall %s", f)
+	})
+	if err != nil {
+		t.Fatalf("newEngine() = %v, want nil error", err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fakeEngine.Run()
+	}()
+
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	for _, port := range []int{22, 80} {
+		captured <- conn(srcIP, dstIP, port)
+	}
+	// The would-be block is recorded once the detection is handled.
+	var st *Stats
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if st = fakeEngine.Stats(); st.TotalBlocks > 0 {
+			break
+		}
+	}
+	fakeEngine.Close()
+	wg.Wait()
+
+	if !st.DryRun {
+		t.Error("Stats().DryRun = false, want true")
+	}
+	var got []string
+	for _, b := range st.Blocks {
+		got = append(got, b.IP.String())
+	}
+	if diff := cmp.Diff([]string{"192.168.86.158"}, got); diff != "" {
+		t.Errorf("Stats().Blocks mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/google/gopacket/layers"
+)
+
+// SYNHeader is the IP and TCP header fields of a SYN (or stealth probe) that
+// tell apart the tools, and operating systems, that send them.
+type SYNHeader struct {
+	// IPID is the IPv4 identification, it's zero for IPv6.
+	IPID uint16
+	// TTL is the IPv4 TTL or IPv6 hop limit.
+	TTL    uint8
+	Window uint16
+	Seq    uint32
+	// Options are the kinds of the TCP options in the order they were sent,
+	// including NOPs but not the end of options.
+	Options []layers.TCPOptionKind
+	// MSS is the maximum segment size option, or zero if there isn't one.
+	MSS uint16
+}
+
+// newSYNHeader returns the SYNHeader of tcp, sent with the given IPv4
+// identification and TTL.
+func newSYNHeader(tcp *layers.TCP, ipid uint16, ttl uint8) *SYNHeader {
+	h := &SYNHeader{IPID: ipid, TTL: ttl, Window: tcp.Window, Seq: tcp.Seq}
+	for _, o := range tcp.Options {
+		h.Options = append(h.Options, o.OptionType)
+		if o.OptionType == layers.TCPOptionKindMSS && len(o.OptionData) == 2 {
+			h.MSS = binary.BigEndian.Uint16(o.OptionData)
+		}
+	}
+	return h
+}
+
+// zmapIPID is the IPv4 identification ZMap sends every probe with.
+const zmapIPID = 54321
+
+// fingerprintTool returns the scanning tool that likely sent v, or "" when it
+// doesn't look like one. A high confidence match is only made from traces
+// that legitimate clients are vanishingly unlikely to leave.
+func fingerprintTool(v *Connection) (tool string, highConfidence bool) {
+	h := v.Header
+	if h == nil {
+		return "", false
+	}
+	// Masscan derives the IP ID from the target and its SYN cookie.
+	if dst := v.Dst.IP.To4(); dst != nil && h.Window == 1024 {
+		if h.IPID == uint16(binary.BigEndian.Uint32(dst)^uint32(v.Dst.Port)^h.Seq) {
+			return "masscan", true
+		}
+	}
+	if h.IPID == zmapIPID && h.Window == 65535 {
+		return "zmap", true
+	}
+	// Nmap's SYN scan only sends an MSS of 1460, in a small window that's a
+	// multiple of 1024. No common operating system does the same, but other
+	// tools could.
+	if len(h.Options) == 1 && h.MSS == 1460 && h.Window%1024 == 0 && h.Window <= 4096 && h.Window > 0 {
+		return "nmap", false
+	}
+	return "", false
+}
+
+// ToolMatch is a SYN that was sent by a scanning tool with high confidence.
+type ToolMatch struct {
+	SrcIP *net.IP
+	DstIP *net.IP
+	Port  int
+	Tool  string
+	Time  time.Time
+}
+
+// String returns the source, destination and tool of m.
+func (m *ToolMatch) String() string {
+	return fmt.Sprintf("%s -> %s:%d looks like %s", m.SrcIP, m.DstIP, m.Port, m.Tool)
+}
+
+// toolTracker is the Detector for SYNs that were sent by a scanning tool with
+// high confidence, so that they are blocked after a single SYN. A source is
+// detected at most once per window, the Evidence is a *ToolMatch.
+type toolTracker struct {
+	*onceTracker
+}
+
+// newToolTracker takes the window a source is detected at most once within
+// and returns an instance of toolTracker.
+func newToolTracker(window, evaluationInterval time.Duration) *toolTracker {
+	return &toolTracker{newOnceTracker(window, evaluationInterval)}
+}
+
+// Add adds the connection v into the tracker, it's detected if it was sent
+// by a scanning tool with high confidence.
+func (t *toolTracker) Add(v *Connection) {
+	tool, high := fingerprintTool(v)
+	if !high {
+		return
+	}
+	now, ok := t.report(v)
+	if !ok {
+		return
+	}
+	log.V(2).Infof("%s sent a SYN from %s", v.Src.IP, tool)
+	m := &ToolMatch{SrcIP: &v.Src.IP, DstIP: &v.Dst.IP, Port: v.Dst.Port, Tool: tool, Time: now}
+	t.detections.emit(&Detection{
+		Detector:  t.Name(),
+		SrcIPs:    []*net.IP{m.SrcIP},
+		Evidence:  m,
+		Severity:  SeverityHigh,
+		FirstSeen: now,
+		LastSeen:  now,
+	})
+}
+
+// Name returns the name of the toolTracker's detections.
+func (t *toolTracker) Name() string {
+	return "scanner fingerprint"
+}
@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket/layers"
+)
+
+// nmapHeader is the header of an nmap -sS SYN.
+var nmapHeader = &SYNHeader{IPID: 4242, TTL: 42, Window: 1024, Seq: 1, Options: []layers.TCPOptionKind{layers.TCPOptionKindMSS}, MSS: 1460}
+
+// masscanHeader returns the header of a masscan SYN to port on dst.
+func masscanHeader(dst net.IP, port int) *SYNHeader {
+	const seq = 0xdeadbeef
+	return &SYNHeader{IPID: uint16(binary.BigEndian.Uint32(dst.To4()) ^ uint32(port) ^ seq), TTL: 255, Window: 1024, Seq: seq}
+}
+
+func TestFingerprintTool(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	// syn returns a SYN to port 22 with header h.
+	syn := func(h *SYNHeader) *Connection {
+		c := conn(srcIP, dstIP, 22)
+		c.Header = h
+		return c
+	}
+	testCases := []struct {
+		desc     string
+		in       *Connection
+		wantTool string
+		wantHigh bool
+	}{
+		{
+			desc:     "test masscan is matched with high confidence",
+			in:       syn(masscanHeader(dstIP, 22)),
+			wantTool: "masscan",
+			wantHigh: true,
+		},
+		{
+			desc:     "test zmap is matched with high confidence",
+			in:       syn(&SYNHeader{IPID: 54321, TTL: 255, Window: 65535, Seq: 1}),
+			wantTool: "zmap",
+			wantHigh: true,
+		},
+		{
+			desc:     "test nmap is matched",
+			in:       syn(nmapHeader),
+			wantTool: "nmap",
+		},
+		{
+			desc: "test linux is not matched",
+			in: syn(&SYNHeader{IPID: 45289, TTL: 64, Window: 64240, Seq: 743214452, Options: []layers.TCPOptionKind{
+				layers.TCPOptionKindMSS, layers.TCPOptionKindSACKPermitted, layers.TCPOptionKindTimestamps, layers.TCPOptionKindNop, layers.TCPOptionKindWindowScale,
+			}, MSS: 1460}),
+		},
+		{
+			desc: "test masscan IP ID for another port is not matched",
+			in:   syn(masscanHeader(dstIP, 80)),
+		},
+		{
+			desc: "test connection without a header is not matched",
+			in:   conn(srcIP, dstIP, 22),
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tool, high := fingerprintTool(tC.in)
+			if tool != tC.wantTool || high != tC.wantHigh {
+				t.Errorf("fingerprintTool() = %q, %t, want %q, %t", tool, high, tC.wantTool, tC.wantHigh)
+			}
+		})
+	}
+}
+
+func TestToolTracker(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	// to returns a SYN to port with header h.
+	to := func(port int, h *SYNHeader) *Connection {
+		c := conn(srcIP, dstIP, port)
+		c.Header = h
+		return c
+	}
+	testCases := []struct {
+		desc string
+		in   []*Connection
+		want []*ToolMatch
+	}{
+		{
+			desc: "test a single masscan SYN is detected once per window",
+			in:   []*Connection{at(0, to(22, masscanHeader(dstIP, 22))), at(1, to(80, masscanHeader(dstIP, 80))), at(60, to(443, masscanHeader(dstIP, 443)))},
+			want: []*ToolMatch{
+				{SrcIP: &srcIP, DstIP: &dstIP, Port: 22, Tool: "masscan", Time: epoch},
+				{SrcIP: &srcIP, DstIP: &dstIP, Port: 443, Tool: "masscan", Time: epoch.Add(time.Minute)},
+			},
+		},
+		{
+			desc: "test nmap SYNs are left to the thresholds",
+			in:   []*Connection{at(0, to(22, nmapHeader)), at(1, to(80, nmapHeader))},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tkr := newToolTracker(time.Minute, time.Hour)
+			tkr.packetClock = true
+			var got []*ToolMatch
+			for _, d := range collect(tkr, tC.in) {
+				got = append(got, d.Evidence.(*ToolMatch))
+			}
+			if diff := cmp.Diff(tC.want, got); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTrackerLabelsTool(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	tkr := newTracker(time.Minute, time.Hour, 1)
+	c := conn(srcIP, dstIP, 80)
+	c.Header = nmapHeader
+	var got []string
+	for _, d := range collect(tkr, []*Connection{conn(srcIP, dstIP, 22), c}) {
+		got = append(got, d.Evidence.String())
+	}
+	want := []string{"192.168.86.158 -> 192.168.86.191 on ports [22 80] (likely nmap)"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+	}
+}
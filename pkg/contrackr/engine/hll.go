@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	// hllPrecision is how many bits of each hash select a register, 8 bits
+	// estimates to within about 6.5%.
+	hllPrecision = 8
+	hllRegisters = 1 << hllPrecision
+)
+
+// hyperLogLog estimates how many distinct values have been added to it, using
+// hllRegisters bytes no matter how many values are added.
+type hyperLogLog [hllRegisters]uint8
+
+// add adds v to the set.
+func (h *hyperLogLog) add(v uint64) {
+	x := mix64(v)
+	i := x >> (64 - hllPrecision)
+	// The sentinel bit caps the rank, should the remaining bits all be zero.
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h[i] {
+		h[i] = rank
+	}
+}
+
+// merge adds every value in o to the set.
+func (h *hyperLogLog) merge(o *hyperLogLog) {
+	for i, r := range o {
+		if r > h[i] {
+			h[i] = r
+		}
+	}
+}
+
+// count returns the estimated number of distinct values in the set.
+func (h *hyperLogLog) count() int {
+	var sum float64
+	var zeros int
+	for _, r := range h {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	m := float64(hllRegisters)
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Small sets are estimated more accurately by counting empty registers.
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return int(est + 0.5)
+}
+
+// mix64 spreads the bits of v over the whole hash (the splitmix64 finalizer),
+// port numbers alone only use the bottom 16 bits.
+func mix64(v uint64) uint64 {
+	v += 0x9e3779b97f4a7c15
+	v = (v ^ v>>30) * 0xbf58476d1ce4e5b9
+	v = (v ^ v>>27) * 0x94d049bb133111eb
+	return v ^ v>>31
+}
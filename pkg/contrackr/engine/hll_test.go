@@ -0,0 +1,45 @@
+package engine
+
+import (
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		distinct int
+		repeats  int
+	}{
+		{desc: "test empty set", distinct: 0, repeats: 1},
+		{desc: "test repeated values are counted once", distinct: 1, repeats: 100},
+		{desc: "test small set", distinct: 20, repeats: 3},
+		{desc: "test every port", distinct: 65536, repeats: 1},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var h hyperLogLog
+			for r := 0; r < tC.repeats; r++ {
+				for i := 0; i < tC.distinct; i++ {
+					h.add(uint64(i))
+				}
+			}
+			// Allow for three standard errors of the estimate, plus rounding.
+			got, tolerance := h.count(), tC.distinct/5+1
+			if got < tC.distinct-tolerance || got > tC.distinct+tolerance {
+				t.Errorf("count() = %d, want %d ± %d", got, tC.distinct, tolerance)
+			}
+		})
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	var a, b hyperLogLog
+	for i := 0; i < 15; i++ {
+		a.add(uint64(i))
+		b.add(uint64(i + 10))
+	}
+	a.merge(&b)
+	if got := a.count(); got < 23 || got > 27 {
+		t.Errorf("count() = %d, want 25 ± 2", got)
+	}
+}
@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ipsetType is the set type used to hold blocked source addresses.
+const ipsetType = "hash:ip"
+
+// ipsets are the names and families of the sets used by the iptables Blocker
+// in ipset mode, in the same order as the ip4tables and ip6tables handles.
+var ipsets = []struct {
+	name, family string
+}{
+	{name: "contrackr4", family: "inet"},
+	{name: "contrackr6", family: "inet6"},
+}
+
+type ipset interface {
+	Exists(string) (bool, error)
+	Create(string, string, ...string) error
+	Add(string, string) error
+	Del(string, string) error
+	Destroy(string) error
+}
+
+// ipsetCmd implements ipset by running the ipset(8) binary.
+type ipsetCmd struct {
+	path string
+}
+
+func newIPSetCmd() (*ipsetCmd, error) {
+	path, err := exec.LookPath("ipset")
+	if err != nil {
+		return nil, err
+	}
+	return &ipsetCmd{path: path}, nil
+}
+
+func (c *ipsetCmd) run(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.path, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipset %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (c *ipsetCmd) Exists(name string) (bool, error) {
+	out, err := c.run("list", "-name")
+	if err != nil {
+		return false, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if strings.TrimSpace(s.Text()) == name {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+func (c *ipsetCmd) Create(name, typ string, options ...string) error {
+	_, err := c.run(append([]string{"create", name, typ}, options...)...)
+	return err
+}
+
+// Add adds entry to the set name, it is not an error if it's already a member.
+func (c *ipsetCmd) Add(name, entry string) error {
+	_, err := c.run("add", name, entry, "-exist")
+	return err
+}
+
+// Del removes entry from the set name, it is not an error if it's not a member.
+func (c *ipsetCmd) Del(name, entry string) error {
+	_, err := c.run("del", name, entry, "-exist")
+	return err
+}
+
+func (c *ipsetCmd) Destroy(name string) error {
+	_, err := c.run("destroy", name)
+	return err
+}
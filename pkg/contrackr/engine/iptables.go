@@ -23,6 +23,9 @@ const (
 // BLocker contains the methods for Blocking IP addresses.
 type Blocker struct {
 	ip4tables, ip6tables iptable
+	// ipset is only set in ipset mode, where a single rule matches against a
+	// set of blocked addresses instead of having a rule per address.
+	ipset ipset
 }
 
 type iptable interface {
@@ -54,13 +57,37 @@ func newBlocker() (*Blocker, error) {
 	return b, b.init()
 }
 
+// newIPSetBlocker returns an instance of Blocker in ipset mode.
+func newIPSetBlocker() (*Blocker, error) {
+	v4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		return nil, err
+	}
+	set, err := newIPSetCmd()
+	if err != nil {
+		return nil, err
+	}
+	b := &Blocker{ip4tables: v4, ip6tables: v6, ipset: set}
+	return b, b.init()
+}
+
+// setRuleSpec returns the rule that drops sources that are members of the
+// set name.
+func setRuleSpec(name string) []string {
+	return []string{"-m", "set", "--match-set", name, "src", "-j", blockAction}
+}
+
 func (b *Blocker) init() error {
 	// Incase Close() wasn't called last time, let's clear any rules before
 	// setup.
 	if err := b.clear(); err != nil {
 		return err
 	}
-	for _, i := range []iptable{b.ip4tables, b.ip6tables} {
+	for n, i := range []iptable{b.ip4tables, b.ip6tables} {
 		// Create our own chain if it doesn't exist.
 		ok, err := i.ChainExists(defaultTable, contrackrChain)
 		if err != nil {
@@ -75,6 +102,16 @@ func (b *Blocker) init() error {
 		if err := i.Insert(defaultTable, inputChain, 1, jumpRuleSpec...); err != nil {
 			return err
 		}
+		// In ipset mode our chain only ever has the one rule.
+		if b.ipset != nil {
+			set := ipsets[n]
+			if err := b.ipset.Create(set.name, ipsetType, "family", set.family); err != nil {
+				return err
+			}
+			if err := i.AppendUnique(defaultTable, contrackrChain, setRuleSpec(set.name)...); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -83,12 +120,35 @@ func (b *Blocker) init() error {
 func (b *Blocker) Block(v *net.IP) error {
 	rule := []string{"-s", v.String(), "-j", blockAction}
 	isV6 := v.To4() == nil
+	if b.ipset != nil {
+		if isV6 {
+			return b.ipset.Add(ipsets[1].name, v.String())
+		}
+		return b.ipset.Add(ipsets[0].name, v.String())
+	}
 	if isV6 {
 		return b.ip6tables.AppendUnique(defaultTable, contrackrChain, rule...)
 	}
 	return b.ip4tables.AppendUnique(defaultTable, contrackrChain, rule...)
 }
 
+// Unblock will take the IP Address v and remove its entry from the host
+// firewall. It is not an error if v isn't blocked.
+func (b *Blocker) Unblock(v *net.IP) error {
+	isV6 := v.To4() == nil
+	if b.ipset != nil {
+		if isV6 {
+			return b.ipset.Del(ipsets[1].name, v.String())
+		}
+		return b.ipset.Del(ipsets[0].name, v.String())
+	}
+	rule := []string{"-s", v.String(), "-j", blockAction}
+	if isV6 {
+		return b.ip6tables.DeleteIfExists(defaultTable, contrackrChain, rule...)
+	}
+	return b.ip4tables.DeleteIfExists(defaultTable, contrackrChain, rule...)
+}
+
 func (b *Blocker) clear() error {
 	var closeErr error
 	for _, i := range []iptable{b.ip4tables, b.ip6tables} {
@@ -100,12 +160,27 @@ func (b *Blocker) clear() error {
 			if err := i.DeleteIfExists(defaultTable, inputChain, jumpRuleSpec...); err != nil {
 				closeErr = fmt.Errorf("deleting jump rule: %v: %w", err, closeErr)
 			}
-			
+
 			if err := i.ClearAndDeleteChain(defaultTable, contrackrChain); err != nil {
 				closeErr = fmt.Errorf("deleting chain: %v", err)
 			}
 		}
 	}
+	// Sets can only be destroyed once no rules reference them, so this must
+	// happen after our chains are gone.
+	if b.ipset != nil {
+		for _, set := range ipsets {
+			ok, err := b.ipset.Exists(set.name)
+			if err != nil {
+				closeErr = fmt.Errorf("set exists: %v", err)
+			}
+			if ok {
+				if err := b.ipset.Destroy(set.name); err != nil {
+					closeErr = fmt.Errorf("destroying set: %v", err)
+				}
+			}
+		}
+	}
 	return closeErr
 }
 
@@ -126,3 +126,117 @@ func TestBlockIpv6(t *testing.T) {
 		t.Errorf("Block() mismatch (-want +got):\n%s", diff)
 	}
 }
+
+// fakeIPSet keeps a list of methods and the order they were executed in.
+type fakeIPSet struct {
+	sets             map[string]bool
+	commandsExecuted []string
+}
+
+func (fs *fakeIPSet) Exists(name string) (bool, error) {
+	fs.commandsExecuted = append(fs.commandsExecuted, fmt.Sprintf("Exists(%s)", name))
+	return fs.sets[name], nil
+}
+
+func (fs *fakeIPSet) Create(name, typ string, options ...string) error {
+	fs.sets[name] = true
+	fs.commandsExecuted = append(fs.commandsExecuted, fmt.Sprintf("Create(%s, %s, %v)", name, typ, options))
+	return nil
+}
+
+func (fs *fakeIPSet) Add(name, entry string) error {
+	fs.commandsExecuted = append(fs.commandsExecuted, fmt.Sprintf("Add(%s, %s)", name, entry))
+	return nil
+}
+
+func (fs *fakeIPSet) Del(name, entry string) error {
+	fs.commandsExecuted = append(fs.commandsExecuted, fmt.Sprintf("Del(%s, %s)", name, entry))
+	return nil
+}
+
+func (fs *fakeIPSet) Destroy(name string) error {
+	delete(fs.sets, name)
+	fs.commandsExecuted = append(fs.commandsExecuted, fmt.Sprintf("Destroy(%s)", name))
+	return nil
+}
+
+func TestBlockIPSet(t *testing.T) {
+	v4 := &fakeIptables{}
+	v6 := &fakeIptables{}
+	set := &fakeIPSet{sets: make(map[string]bool)}
+	b := &Blocker{ip4tables: v4, ip6tables: v6, ipset: set}
+	ip4, ip6 := net.ParseIP("127.0.0.1"), net.ParseIP("2001:4860:4860::8888")
+	b.init()
+	b.Block(&ip4)
+	b.Block(&ip6)
+	b.Unblock(&ip4)
+	b.Close()
+
+	wantv4 := []string{
+		"ChainExists(filter, contrackr)",
+		"ChainExists(filter, contrackr)",
+		"NewChain(filter, contrackr)",
+		"Insert(filter, INPUT, 1, [-m state --state NEW -j contrackr])",
+		"AppendUnique(filter, contrackr, [-m set --match-set contrackr4 src -j DROP])",
+		"ChainExists(filter, contrackr)",
+		"DeleteIfExists(filter, INPUT, [-m state --state NEW -j contrackr])",
+		"ClearAndDeleteChain(filter, contrackr)",
+	}
+
+	wantv6 := []string{
+		"ChainExists(filter, contrackr)",
+		"ChainExists(filter, contrackr)",
+		"NewChain(filter, contrackr)",
+		"Insert(filter, INPUT, 1, [-m state --state NEW -j contrackr])",
+		"AppendUnique(filter, contrackr, [-m set --match-set contrackr6 src -j DROP])",
+		"ChainExists(filter, contrackr)",
+		"DeleteIfExists(filter, INPUT, [-m state --state NEW -j contrackr])",
+		"ClearAndDeleteChain(filter, contrackr)",
+	}
+
+	wantSet := []string{
+		"Exists(contrackr4)",
+		"Exists(contrackr6)",
+		"Create(contrackr4, hash:ip, [family inet])",
+		"Create(contrackr6, hash:ip, [family inet6])",
+		"Add(contrackr4, 127.0.0.1)",
+		"Add(contrackr6, 2001:4860:4860::8888)",
+		"Del(contrackr4, 127.0.0.1)",
+		"Exists(contrackr4)",
+		"Destroy(contrackr4)",
+		"Exists(contrackr6)",
+		"Destroy(contrackr6)",
+	}
+
+	if diff := cmp.Diff(wantv4, v4.commandsExecuted); diff != "" {
+		t.Errorf("Block() mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(wantv6, v6.commandsExecuted); diff != "" {
+		t.Errorf("Block() mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(wantSet, set.commandsExecuted); diff != "" {
+		t.Errorf("Block() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestUnblock(t *testing.T) {
+	v4 := &fakeIptables{chainSetup: true}
+	v6 := &fakeIptables{chainSetup: true}
+	b := &Blocker{ip4tables: v4, ip6tables: v6}
+	ip4, ip6 := net.ParseIP("127.0.0.1"), net.ParseIP("2001:4860:4860::8888")
+	b.Unblock(&ip4)
+	b.Unblock(&ip6)
+
+	wantv4 := []string{"DeleteIfExists(filter, contrackr, [-s 127.0.0.1 -j DROP])"}
+	wantv6 := []string{"DeleteIfExists(filter, contrackr, [-s 2001:4860:4860::8888 -j DROP])"}
+
+	if diff := cmp.Diff(wantv4, v4.commandsExecuted); diff != "" {
+		t.Errorf("Unblock() mismatch (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(wantv6, v6.commandsExecuted); diff != "" {
+		t.Errorf("Unblock() mismatch (-want +got):\n%s", diff)
+	}
+}
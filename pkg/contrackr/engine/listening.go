@@ -0,0 +1,210 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	log "github.com/golang/glog"
+)
+
+// procNetDir is where the kernel lists the host's sockets.
+const procNetDir = "/proc/net"
+
+// Socket states in /proc/net, a bound UDP socket that isn't connected is
+// listed as closed.
+const (
+	procStateListen = "0A"
+	procStateClose  = "07"
+)
+
+// procNetFiles are the socket tables that are read for each protocol, and the
+// state of their listening sockets.
+var procNetFiles = []struct {
+	name     string
+	protocol Protocol
+	state    string
+}{
+	{"tcp", ProtocolTCP, procStateListen},
+	{"tcp6", ProtocolTCP, procStateListen},
+	{"udp", ProtocolUDP, procStateClose},
+	{"udp6", ProtocolUDP, procStateClose},
+}
+
+// nativeEndian is the byte order of the host.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	v := uint16(1)
+	if *(*byte)(unsafe.Pointer(&v)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// listenAddr is the local address a socket is listening on, an unspecified IP
+// (eg. 0.0.0.0) listens on every address.
+type listenAddr struct {
+	IP   string
+	Port int
+}
+
+// listeningPorts is the set of TCP and UDP addresses the host is listening
+// on, read from /proc/net and refreshed periodically. Sockets bound to a
+// loopback address aren't reachable by scanners, so they aren't included. A
+// single listeningPorts is shared by every Detector that needs it.
+type listeningPorts struct {
+	dir   string
+	done  chan struct{}
+	close sync.Once
+	// protects everything below.
+	l     sync.RWMutex
+	ports map[Protocol]map[listenAddr]bool
+}
+
+// newListeningPorts takes the directory the socket tables are read from, and
+// how often they're read and returns an instance of listeningPorts.
+func newListeningPorts(dir string, refresh time.Duration) (p *listeningPorts) {
+	p = &listeningPorts{
+		dir:  dir,
+		done: make(chan struct{}),
+	}
+	p.refresh()
+	go func() {
+		tick := time.NewTicker(refresh)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-p.done:
+				return
+			}
+			p.refresh()
+		}
+	}()
+	return
+}
+
+// refresh reads the listening ports again, they're left as they were if the
+// socket tables can't be read.
+func (p *listeningPorts) refresh() {
+	ports, err := readListeningPorts(p.dir)
+	if err != nil {
+		log.Errorf("unable to read listening ports: %v", err)
+		return
+	}
+	p.l.Lock()
+	p.ports = ports
+	p.l.Unlock()
+}
+
+// has returns true when the host is listening on ip and port for protocol,
+// either on ip itself or on every address. It's false for every address when
+// p is nil.
+func (p *listeningPorts) has(protocol Protocol, ip net.IP, port int) bool {
+	if p == nil {
+		return false
+	}
+	p.l.RLock()
+	defer p.l.RUnlock()
+	addrs := p.ports[protocol]
+	// An IPv6 socket listening on every address also accepts IPv4.
+	if addrs[listenAddr{ip.String(), port}] || addrs[listenAddr{net.IPv6unspecified.String(), port}] {
+		return true
+	}
+	return ip.To4() != nil && addrs[listenAddr{net.IPv4zero.String(), port}]
+}
+
+// Close stops refreshing the listening ports, it's safe to call more than
+// once.
+func (p *listeningPorts) Close() {
+	p.close.Do(func() { close(p.done) })
+}
+
+// readListeningPorts returns the listening addresses in the socket tables in
+// dir, a table that doesn't exist (eg. tcp6 when IPv6 is disabled) is skipped.
+func readListeningPorts(dir string) (map[Protocol]map[listenAddr]bool, error) {
+	ports := make(map[Protocol]map[listenAddr]bool)
+	for _, f := range procNetFiles {
+		r, err := os.Open(filepath.Join(dir, f.name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		listening, err := parseProcNet(r, f.state)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+		if ports[f.protocol] == nil {
+			ports[f.protocol] = make(map[listenAddr]bool)
+		}
+		for _, a := range listening {
+			ports[f.protocol][a] = true
+		}
+	}
+	return ports, nil
+}
+
+// parseProcNet returns the local addresses of the sockets in state, that
+// aren't bound to a loopback address, from a /proc/net socket table such as
+// /proc/net/tcp.
+func parseProcNet(r io.Reader, state string) ([]listenAddr, error) {
+	var addrs []listenAddr
+	s := bufio.NewScanner(r)
+	// The first line is the header.
+	for n := 1; s.Scan(); n++ {
+		f := strings.Fields(s.Text())
+		if n == 1 {
+			continue
+		}
+		if len(f) < 4 {
+			return nil, fmt.Errorf("line %d: expected at least 4 fields, got %d", n, len(f))
+		}
+		if f[3] != state {
+			continue
+		}
+		// The local address is the hex IP and port, eg. 0100007F:0035.
+		addr := strings.SplitN(f[1], ":", 2)
+		if len(addr) != 2 {
+			return nil, fmt.Errorf("line %d: invalid local address %q", n, f[1])
+		}
+		ip, err := parseProcIP(addr[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		port, err := strconv.ParseUint(addr[1], 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid port %q", n, addr[1])
+		}
+		if !ip.IsLoopback() {
+			addrs = append(addrs, listenAddr{IP: ip.String(), Port: int(port)})
+		}
+	}
+	return addrs, s.Err()
+}
+
+// parseProcIP parses an IP address from a /proc/net socket table, which is
+// written as 32 bit words in host byte order.
+func parseProcIP(v string) (net.IP, error) {
+	b, err := hex.DecodeString(v)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, fmt.Errorf("invalid IP address %q", v)
+	}
+	// Each word of the address was printed as a number read in host byte
+	// order, so write it back the same way.
+	for i := 0; i < len(b); i += 4 {
+		nativeEndian.PutUint32(b[i:], binary.BigEndian.Uint32(b[i:]))
+	}
+	return net.IP(b), nil
+}
@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadListeningPorts(t *testing.T) {
+	got, err := readListeningPorts("testdata/proc_net")
+	if err != nil {
+		t.Fatalf("readListeningPorts() returned err=%v, want nil error", err)
+	}
+	// Loopback and connected sockets aren't listening, and udp6 is missing.
+	want := map[Protocol]map[listenAddr]bool{
+		ProtocolTCP: {{"0.0.0.0", 22}: true, {"192.168.86.158", 80}: true, {"::", 443}: true},
+		ProtocolUDP: {{"0.0.0.0", 53}: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("readListeningPorts() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseProcNet(t *testing.T) {
+	const header = "  sl  local_address rem_address   st\n"
+	testCases := []struct {
+		desc    string
+		in      string
+		want    []listenAddr
+		wantErr bool
+	}{
+		{
+			desc: "test listening sockets are parsed",
+			in:   header + "   0: 00000000:0016 00000000:0000 0A\n   1: 9E56A8C0:0050 00000000:0000 0A\n",
+			want: []listenAddr{{"0.0.0.0", 22}, {"192.168.86.158", 80}},
+		},
+		{
+			desc:    "test invalid port is an error",
+			in:      header + "   0: 00000000:XYZ 00000000:0000 0A\n",
+			wantErr: true,
+		},
+		{
+			desc:    "test invalid IP address is an error",
+			in:      header + "   0: 000000:0016 00000000:0000 0A\n",
+			wantErr: true,
+		},
+		{
+			desc:    "test truncated line is an error",
+			in:      header + "   0: 00000000:0016\n",
+			wantErr: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			got, err := parseProcNet(strings.NewReader(tC.in), procStateListen)
+			if (err != nil) != tC.wantErr {
+				t.Fatalf("parseProcNet() returned err=%v, want err=%t", err, tC.wantErr)
+			}
+			if diff := cmp.Diff(tC.want, got); diff != "" {
+				t.Errorf("parseProcNet() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestListeningPortsHas(t *testing.T) {
+	p := newListeningPorts("testdata/proc_net", time.Hour)
+	defer p.Close()
+	testCases := []struct {
+		desc     string
+		protocol Protocol
+		ip       string
+		port     int
+		want     bool
+	}{
+		{
+			desc:     "test a port listening on every IPv4 address",
+			protocol: ProtocolTCP, ip: "192.168.86.191", port: 22, want: true,
+		},
+		{
+			desc:     "test a port listening on every IPv4 address isn't listening on IPv6",
+			protocol: ProtocolTCP, ip: "2001:db8::1", port: 22,
+		},
+		{
+			desc:     "test a port listening on every IPv6 address is listening on IPv4",
+			protocol: ProtocolTCP, ip: "192.168.86.191", port: 443, want: true,
+		},
+		{
+			desc:     "test a port listening on one address",
+			protocol: ProtocolTCP, ip: "192.168.86.158", port: 80, want: true,
+		},
+		{
+			desc:     "test a port listening on one address isn't listening on another",
+			protocol: ProtocolTCP, ip: "192.168.86.191", port: 80,
+		},
+		{
+			desc:     "test a port listening on loopback isn't listening",
+			protocol: ProtocolTCP, ip: "192.168.86.191", port: 3306,
+		},
+		{
+			desc:     "test ports are per protocol",
+			protocol: ProtocolUDP, ip: "192.168.86.191", port: 22,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if got := p.has(tC.protocol, net.ParseIP(tC.ip), tC.port); got != tC.want {
+				t.Errorf("has(%s, %s, %d) = %t, want %t", tC.protocol, tC.ip, tC.port, got, tC.want)
+			}
+		})
+	}
+}
+
+func TestTrackerExemptsListeningPorts(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	otherDstIP := net.ParseIP("192.168.86.192")
+	testCases := []struct {
+		desc string
+		// bySrc tracks connections by Src IP alone, rather than by Src and
+		// Dst IP.
+		bySrc bool
+		in    []*Connection
+		want  []map[int]int
+	}{
+		{
+			desc: "test a client of listening ports isn't a port scanner",
+			in:   []*Connection{conn(srcIP, dstIP, 22), conn(srcIP, dstIP, 443), conn(srcIP, dstIP, 8080)},
+		},
+		{
+			desc: "test a port listening on one address is counted on another",
+			in:   []*Connection{conn(srcIP, otherDstIP, 22), conn(srcIP, otherDstIP, 80), conn(srcIP, otherDstIP, 443), conn(srcIP, otherDstIP, 3306), conn(srcIP, otherDstIP, 6379), conn(srcIP, otherDstIP, 9200)},
+			want: []map[int]int{{22: 1, 80: 1, 443: 1, 3306: 1, 6379: 1, 9200: 1}},
+		},
+		{
+			desc:  "test a port listening on only some of an entry's addresses is counted",
+			bySrc: true,
+			in:    []*Connection{conn(otherDstIP, srcIP, 80), conn(otherDstIP, dstIP, 80), conn(otherDstIP, dstIP, 3306), conn(otherDstIP, dstIP, 6379), conn(otherDstIP, dstIP, 9200)},
+			want:  []map[int]int{{80: 2, 3306: 1, 6379: 1, 9200: 1}},
+		},
+		{
+			desc: "test closed ports are still counted",
+			in:   []*Connection{conn(srcIP, dstIP, 22), conn(srcIP, dstIP, 3306), conn(srcIP, dstIP, 6379), conn(srcIP, dstIP, 8080), conn(srcIP, dstIP, 9200)},
+			want: []map[int]int{{22: 1, 3306: 1, 6379: 1, 8080: 1, 9200: 1}},
+		},
+		{
+			desc: "test listening ports are per protocol",
+			in:   []*Connection{udp(conn(srcIP, dstIP, 22), false), udp(conn(srcIP, dstIP, 53), false), udp(conn(srcIP, dstIP, 80), false), udp(conn(srcIP, dstIP, 443), false), udp(conn(srcIP, dstIP, 123), false)},
+			want: []map[int]int{{22: 1, 53: 1, 80: 1, 443: 1, 123: 1}},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tkr := newTracker(time.Minute, time.Hour, 3)
+			tkr.listening = newListeningPorts("testdata/proc_net", time.Hour)
+			if tC.bySrc {
+				tkr.key = srcKey
+			}
+			var got []map[int]int
+			for _, d := range collect(tkr, tC.in) {
+				got = append(got, d.Evidence.(*TrackerEntry).Ports)
+			}
+			if diff := cmp.Diff(tC.want, got); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// nftFamily is the address family of our table. The inet family sees both
+	// IPv4 and IPv6 traffic, so a single table and chain covers both.
+	nftFamily = "inet"
+	// we use our own table to keep things seperated. It will be deleted (along
+	// with everything in it) on teardown.
+	nftTable = "contrackr"
+	// nftChain is the base chain that hooks into input.
+	nftChain = "input"
+	// named sets that hold the blocked source addresses, nftables sets are
+	// typed so IPv4 and IPv6 need a set each.
+	nftSet4 = "blocked4"
+	nftSet6 = "blocked6"
+)
+
+var (
+	// nftChainSpec hooks our chain into input at the same priority as the
+	// iptables filter table, accepting anything that our rules don't drop.
+	nftChainSpec = []string{"{", "type", "filter", "hook", "input", "priority", "0", ";", "policy", "accept", ";", "}"}
+	// nftRuleSpecs drops new connections from any source in our sets, this
+	// mirrors jumpRuleSpec + blockAction in the iptables Blocker.
+	nftRuleSpecs = [][]string{
+		{"ct", "state", "new", "ip", "saddr", "@" + nftSet4, "drop"},
+		{"ct", "state", "new", "ip6", "saddr", "@" + nftSet6, "drop"},
+	}
+)
+
+// errNFTNotFound is returned by nftable when the object being deleted, such as
+// a set element, doesn't exist.
+var errNFTNotFound = errors.New("no such object")
+
+// NFTBlocker contains the methods for Blocking IP addresses with nftables.
+type NFTBlocker struct {
+	nft nftable
+}
+
+type nftable interface {
+	TableExists(string, string) (bool, error)
+	AddTable(string, string) error
+	DeleteTable(string, string) error
+	AddSet(string, string, string, string) error
+	AddChain(string, string, string, ...string) error
+	AddRule(string, string, string, ...string) error
+	AddElement(string, string, string, string) error
+	DeleteElement(string, string, string, string) error
+}
+
+// newNFTBlocker returns an instance of NFTBlocker.
+func newNFTBlocker() (*NFTBlocker, error) {
+	path, err := exec.LookPath("nft")
+	if err != nil {
+		return nil, err
+	}
+	b := &NFTBlocker{nft: &nftCmd{path: path}}
+	return b, b.init()
+}
+
+func (b *NFTBlocker) init() error {
+	// Incase Close() wasn't called last time, let's remove the table before
+	// setup.
+	if err := b.clear(); err != nil {
+		return err
+	}
+	if err := b.nft.AddTable(nftFamily, nftTable); err != nil {
+		return err
+	}
+	for _, set := range [][2]string{{nftSet4, "ipv4_addr"}, {nftSet6, "ipv6_addr"}} {
+		if err := b.nft.AddSet(nftFamily, nftTable, set[0], set[1]); err != nil {
+			return err
+		}
+	}
+	if err := b.nft.AddChain(nftFamily, nftTable, nftChain, nftChainSpec...); err != nil {
+		return err
+	}
+	for _, rule := range nftRuleSpecs {
+		if err := b.nft.AddRule(nftFamily, nftTable, nftChain, rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Block will take the IP Address v and add it to the blocked set.
+func (b *NFTBlocker) Block(v *net.IP) error {
+	isV6 := v.To4() == nil
+	if isV6 {
+		return b.nft.AddElement(nftFamily, nftTable, nftSet6, v.String())
+	}
+	return b.nft.AddElement(nftFamily, nftTable, nftSet4, v.String())
+}
+
+// Unblock will take the IP Address v and remove it from the blocked set. An IP
+// that isn't in the set is already unblocked, like ipset -exist and
+// iptables DeleteIfExists.
+func (b *NFTBlocker) Unblock(v *net.IP) error {
+	set := nftSet4
+	if v.To4() == nil {
+		set = nftSet6
+	}
+	if err := b.nft.DeleteElement(nftFamily, nftTable, set, v.String()); err != nil && !errors.Is(err, errNFTNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (b *NFTBlocker) clear() error {
+	ok, err := b.nft.TableExists(nftFamily, nftTable)
+	if err != nil {
+		return fmt.Errorf("table exists: %v", err)
+	}
+	if ok {
+		if err := b.nft.DeleteTable(nftFamily, nftTable); err != nil {
+			return fmt.Errorf("deleting table: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close will cleanup the table that was created during instantiation.
+func (b *NFTBlocker) Close() error {
+	return b.clear()
+}
+
+// nftCmd implements nftable by running the nft(8) binary, much like
+// go-iptables does for iptables.
+type nftCmd struct {
+	path string
+}
+
+func (n *nftCmd) run(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(n.path, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		// nft reports ENOENT for objects that don't exist.
+		if strings.Contains(msg, "No such file or directory") {
+			err = errNFTNotFound
+		}
+		return nil, fmt.Errorf("nft %s: %w: %s", strings.Join(args, " "), err, msg)
+	}
+	return out, nil
+}
+
+func (n *nftCmd) TableExists(family, table string) (bool, error) {
+	out, err := n.run("list", "tables", family)
+	if err != nil {
+		return false, err
+	}
+	want := fmt.Sprintf("table %s %s", family, table)
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if strings.TrimSpace(s.Text()) == want {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+func (n *nftCmd) AddTable(family, table string) error {
+	_, err := n.run("add", "table", family, table)
+	return err
+}
+
+func (n *nftCmd) DeleteTable(family, table string) error {
+	_, err := n.run("delete", "table", family, table)
+	return err
+}
+
+func (n *nftCmd) AddSet(family, table, set, typ string) error {
+	_, err := n.run("add", "set", family, table, set, "{", "type", typ, ";", "}")
+	return err
+}
+
+func (n *nftCmd) AddChain(family, table, chain string, chainspec ...string) error {
+	_, err := n.run(append([]string{"add", "chain", family, table, chain}, chainspec...)...)
+	return err
+}
+
+func (n *nftCmd) AddRule(family, table, chain string, rulespec ...string) error {
+	_, err := n.run(append([]string{"add", "rule", family, table, chain}, rulespec...)...)
+	return err
+}
+
+func (n *nftCmd) AddElement(family, table, set, element string) error {
+	_, err := n.run("add", "element", family, table, set, "{", element, "}")
+	return err
+}
+
+func (n *nftCmd) DeleteElement(family, table, set, element string) error {
+	_, err := n.run("delete", "element", family, table, set, "{", element, "}")
+	return err
+}
@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeNftables keeps a list of methods and the order they were executed in.
+type fakeNftables struct {
+	tableSetup       bool
+	commandsExecuted []string
+	// deleteErr is returned by DeleteElement.
+	deleteErr error
+}
+
+func (fn *fakeNftables) TableExists(family, table string) (bool, error) {
+	fn.commandsExecuted = append(fn.commandsExecuted, fmt.Sprintf("TableExists(%s, %s)", family, table))
+	return fn.tableSetup, nil
+}
+
+func (fn *fakeNftables) AddTable(family, table string) error {
+	fn.tableSetup = true
+	fn.commandsExecuted = append(fn.commandsExecuted, fmt.Sprintf("AddTable(%s, %s)", family, table))
+	return nil
+}
+
+func (fn *fakeNftables) DeleteTable(family, table string) error {
+	fn.tableSetup = false
+	fn.commandsExecuted = append(fn.commandsExecuted, fmt.Sprintf("DeleteTable(%s, %s)", family, table))
+	return nil
+}
+
+func (fn *fakeNftables) AddSet(family, table, set, typ string) error {
+	m := fmt.Sprintf("AddSet(%s, %s, %s, %s)", family, table, set, typ)
+	fn.commandsExecuted = append(fn.commandsExecuted, m)
+	return nil
+}
+
+func (fn *fakeNftables) AddChain(family, table, chain string, chainspec ...string) error {
+	m := fmt.Sprintf("AddChain(%s, %s, %s, %v)", family, table, chain, chainspec)
+	fn.commandsExecuted = append(fn.commandsExecuted, m)
+	return nil
+}
+
+func (fn *fakeNftables) AddRule(family, table, chain string, rulespec ...string) error {
+	m := fmt.Sprintf("AddRule(%s, %s, %s, %v)", family, table, chain, rulespec)
+	fn.commandsExecuted = append(fn.commandsExecuted, m)
+	return nil
+}
+
+func (fn *fakeNftables) AddElement(family, table, set, element string) error {
+	m := fmt.Sprintf("AddElement(%s, %s, %s, %s)", family, table, set, element)
+	fn.commandsExecuted = append(fn.commandsExecuted, m)
+	return nil
+}
+
+func (fn *fakeNftables) DeleteElement(family, table, set, element string) error {
+	m := fmt.Sprintf("DeleteElement(%s, %s, %s, %s)", family, table, set, element)
+	fn.commandsExecuted = append(fn.commandsExecuted, m)
+	return fn.deleteErr
+}
+
+func TestNFTBlock(t *testing.T) {
+	setup := []string{
+		"TableExists(inet, contrackr)",
+		"AddTable(inet, contrackr)",
+		"AddSet(inet, contrackr, blocked4, ipv4_addr)",
+		"AddSet(inet, contrackr, blocked6, ipv6_addr)",
+		"AddChain(inet, contrackr, input, [{ type filter hook input priority 0 ; policy accept ; }])",
+		"AddRule(inet, contrackr, input, [ct state new ip saddr @blocked4 drop])",
+		"AddRule(inet, contrackr, input, [ct state new ip6 saddr @blocked6 drop])",
+	}
+	teardown := []string{
+		"TableExists(inet, contrackr)",
+		"DeleteTable(inet, contrackr)",
+	}
+	testCases := []struct {
+		desc string
+		ip   string
+		want []string
+	}{
+		{
+			desc: "test IPv4 is added to and removed from the v4 set",
+			ip:   "127.0.0.1",
+			want: []string{
+				"AddElement(inet, contrackr, blocked4, 127.0.0.1)",
+				"DeleteElement(inet, contrackr, blocked4, 127.0.0.1)",
+			},
+		},
+		{
+			desc: "test IPv6 is added to and removed from the v6 set",
+			ip:   "2001:4860:4860::8888",
+			want: []string{
+				"AddElement(inet, contrackr, blocked6, 2001:4860:4860::8888)",
+				"DeleteElement(inet, contrackr, blocked6, 2001:4860:4860::8888)",
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			nft := &fakeNftables{}
+			b := &NFTBlocker{nft: nft}
+			ip := net.ParseIP(tC.ip)
+			if err := b.init(); err != nil {
+				t.Fatalf("init() = %v, want nil error", err)
+			}
+			if err := b.Block(&ip); err != nil {
+				t.Errorf("Block(%s) = %v, want nil error", tC.ip, err)
+			}
+			if err := b.Unblock(&ip); err != nil {
+				t.Errorf("Unblock(%s) = %v, want nil error", tC.ip, err)
+			}
+			if err := b.Close(); err != nil {
+				t.Errorf("Close() = %v, want nil error", err)
+			}
+
+			want := append(append(append([]string{}, setup...), tC.want...), teardown...)
+			if diff := cmp.Diff(want, nft.commandsExecuted); diff != "" {
+				t.Errorf("Block() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNFTInitRemovesStaleTable(t *testing.T) {
+	// A table left behind by a previous run that wasn't closed cleanly.
+	nft := &fakeNftables{tableSetup: true}
+	b := &NFTBlocker{nft: nft}
+	if err := b.init(); err != nil {
+		t.Fatalf("init() = %v, want nil error", err)
+	}
+	want := []string{"TableExists(inet, contrackr)", "DeleteTable(inet, contrackr)", "AddTable(inet, contrackr)"}
+	if diff := cmp.Diff(want, nft.commandsExecuted[:3]); diff != "" {
+		t.Errorf("init() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNFTUnblockMissingElement(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		deleteErr error
+		wantErr   bool
+	}{
+		{
+			desc:      "test an element that's already gone is unblocked",
+			deleteErr: fmt.Errorf("nft delete element: %w: Error: Could not process rule: No such file or directory", errNFTNotFound),
+		},
+		{
+			desc:      "test other errors are returned",
+			deleteErr: errors.New("nft delete element: exit status 1: Error: Operation not permitted"),
+			wantErr:   true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			b := &NFTBlocker{nft: &fakeNftables{deleteErr: tC.deleteErr}}
+			ip := net.ParseIP("192.168.86.158")
+			if err := b.Unblock(&ip); (err != nil) != tC.wantErr {
+				t.Errorf("Unblock() = %v, want err=%t", err, tC.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,675 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The defaults that Options are applied over, flags can default to them too.
+const (
+	// how many distinct ports a source can connect to before it's a port
+	// scanner.
+	DefaultMinimumPortScanned = 3
+	// how many hosts a source can connect to the same port on before it's
+	// sweeping, 0 leaves it disabled.
+	DefaultMinimumHostsScanned = 0
+	// how long do entries get tracked for.
+	DefaultTrackerEntryTTL = 1 * time.Minute
+	// how often do we evaluate our entries (ideally more often than entry TTL)
+	DefaultEvaluationInterval = 1 * time.Second
+	// how long are port scanners blocked for by default.
+	DefaultBlockDuration = 1 * time.Hour
+	// how long is a repeat offender remembered for after its block expired.
+	DefaultFindTime = 24 * time.Hour
+	// the source prefix lengths used by AggregatePrefix by default.
+	DefaultPrefixV4 = 24
+	DefaultPrefixV6 = 64
+	// how many distinct ports a source can connect to over the slow scan
+	// horizon before it's a low-and-slow port scanner, 0 leaves it disabled.
+	DefaultSlowScanThreshold = 0
+	DefaultSlowScanHorizon   = 6 * time.Hour
+	// the window sources are correlated within for distributed scans.
+	DefaultDistributedScanWindow = 30 * time.Second
+	// the window ICMP probes are counted within for ping scans.
+	DefaultPingScanWindow = 10 * time.Second
+	// how connections are grouped when counting ports.
+	DefaultAggregation = AggregateSrcDst
+	// the firewall port scanners are blocked with.
+	DefaultFirewall = FirewallIPTables
+)
+
+// Option configures optional behaviour of an Engine.
+type Option func(*options)
+
+type options struct {
+	minimumPortScanned int
+	// a minimumHostsScanned of 0 disables sweep detection.
+	minimumHostsScanned int
+	trackerEntryTTL     time.Duration
+	evaluationInterval  time.Duration
+	aggregation         Aggregation
+	prefixV4, prefixV6  int
+	// key is derived from aggregation and the prefix lengths.
+	key keyFunc
+	// a slowScanThreshold of 0 disables low-and-slow detection.
+	slowScanThreshold int
+	slowScanHorizon   time.Duration
+	// a distributedScanThreshold of 0 disables distributed scan detection.
+	distributedScanThreshold int
+	distributedScanWindow    time.Duration
+	blockDistributedScans    bool
+	servicePorts             []int
+	tripwirePorts            []int
+	blockSpoofableTripwires  bool
+	portWeights              map[Protocol]map[int]int
+	listening                bool
+	listeningWeight          int
+	listeningRefresh         time.Duration
+	udp                      bool
+	sctp                     bool
+	// unanswered only counts the SYNs that the host doesn't answer with a
+	// SYN-ACK.
+	unanswered bool
+	// stealth enables stealth scan detection, on the first probe when
+	// stealthFirstProbe is set.
+	stealth           bool
+	stealthFirstProbe bool
+	// blockTools blocks sources on a single SYN sent by a scanning tool with
+	// high confidence.
+	blockTools bool
+	// osDatabase guesses the operating system of port scanners, it may be
+	// nil.
+	osDatabase *OSDatabase
+	// a pingScanHosts and pingScanPackets of 0 disables ping scan detection.
+	pingScanHosts   int
+	pingScanPackets int
+	pingScanWindow  time.Duration
+	// detectors are added alongside the built in Detectors.
+	detectors []Detector
+	firewall  Firewall
+	ladder    []time.Duration
+	findTime  time.Duration
+	allowlist allowlist
+	dryRun    bool
+}
+
+// newOptions applies opts over the defaults, and returns an error for
+// any nonsensical combination.
+func newOptions(opts []Option) (*options, error) {
+	o := &options{
+		minimumPortScanned:    DefaultMinimumPortScanned,
+		trackerEntryTTL:       DefaultTrackerEntryTTL,
+		evaluationInterval:    DefaultEvaluationInterval,
+		aggregation:           DefaultAggregation,
+		prefixV4:              DefaultPrefixV4,
+		prefixV6:              DefaultPrefixV6,
+		slowScanThreshold:     DefaultSlowScanThreshold,
+		slowScanHorizon:       DefaultSlowScanHorizon,
+		distributedScanWindow: DefaultDistributedScanWindow,
+		pingScanWindow:        DefaultPingScanWindow,
+		firewall:              DefaultFirewall,
+		ladder:                []time.Duration{DefaultBlockDuration},
+		findTime:              DefaultFindTime,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.minimumPortScanned < 1 {
+		return nil, fmt.Errorf("minimum ports scanned %d must be at least 1", o.minimumPortScanned)
+	}
+	if o.minimumHostsScanned < 0 {
+		return nil, fmt.Errorf("minimum hosts scanned %d must not be negative", o.minimumHostsScanned)
+	}
+	if o.trackerEntryTTL <= 0 {
+		return nil, fmt.Errorf("tracker entry TTL %v must be positive", o.trackerEntryTTL)
+	}
+	if o.evaluationInterval <= 0 {
+		return nil, fmt.Errorf("evaluation interval %v must be positive", o.evaluationInterval)
+	}
+	if o.evaluationInterval > o.trackerEntryTTL {
+		return nil, fmt.Errorf("evaluation interval %v is longer than the tracker entry TTL %v", o.evaluationInterval, o.trackerEntryTTL)
+	}
+	switch o.aggregation {
+	case AggregateSrcDst:
+		o.key = srcDstKey
+	case AggregateSrc:
+		o.key = srcKey
+	case AggregatePrefix:
+		if o.prefixV4 < 1 || o.prefixV4 > 32 {
+			return nil, fmt.Errorf("IPv4 prefix length %d must be between 1 and 32", o.prefixV4)
+		}
+		if o.prefixV6 < 1 || o.prefixV6 > 128 {
+			return nil, fmt.Errorf("IPv6 prefix length %d must be between 1 and 128", o.prefixV6)
+		}
+		o.key = srcPrefixKey(o.prefixV4, o.prefixV6)
+	default:
+		return nil, fmt.Errorf("unknown aggregation %q", o.aggregation)
+	}
+	if o.slowScanThreshold < 0 {
+		return nil, fmt.Errorf("slow scan threshold %d must not be negative", o.slowScanThreshold)
+	}
+	if o.slowScanThreshold > 0 && o.slowScanHorizon <= o.trackerEntryTTL {
+		return nil, fmt.Errorf("slow scan horizon %v must be longer than the tracker entry TTL %v", o.slowScanHorizon, o.trackerEntryTTL)
+	}
+	if o.distributedScanThreshold < 0 {
+		return nil, fmt.Errorf("distributed scan threshold %d must not be negative", o.distributedScanThreshold)
+	}
+	if o.distributedScanThreshold > 0 && o.distributedScanWindow <= 0 {
+		return nil, fmt.Errorf("distributed scan window %v must be positive", o.distributedScanWindow)
+	}
+	if o.pingScanHosts < 0 || o.pingScanPackets < 0 {
+		return nil, fmt.Errorf("ping scan hosts %d and packets %d must not be negative", o.pingScanHosts, o.pingScanPackets)
+	}
+	if o.pingScan() && o.pingScanWindow <= 0 {
+		return nil, fmt.Errorf("ping scan window %v must be positive", o.pingScanWindow)
+	}
+	for _, p := range o.servicePorts {
+		if p < 1 || p > 65535 {
+			return nil, fmt.Errorf("service port %d must be between 1 and 65535", p)
+		}
+	}
+	for proto, weights := range o.portWeights {
+		if !proto.hasPorts() {
+			return nil, fmt.Errorf("weighted protocol %s has no ports", proto)
+		}
+		for p, w := range weights {
+			if p < 1 || p > 65535 {
+				return nil, fmt.Errorf("weighted %s port %d must be between 1 and 65535", proto, p)
+			}
+			if w < 0 {
+				return nil, fmt.Errorf("weight %d of %s port %d must not be negative", w, proto, p)
+			}
+		}
+	}
+	if o.listening {
+		if o.listeningWeight < 0 {
+			return nil, fmt.Errorf("listening port weight %d must not be negative", o.listeningWeight)
+		}
+		if o.listeningRefresh <= 0 {
+			return nil, fmt.Errorf("listening port refresh %v must be positive", o.listeningRefresh)
+		}
+	}
+	for _, p := range o.tripwirePorts {
+		if p < 1 || p > 65535 {
+			return nil, fmt.Errorf("tripwire port %d must be between 1 and 65535", p)
+		}
+	}
+	// The firewall is checked even on a dry run, so that switching it off
+	// doesn't turn up a typo.
+	switch o.firewall {
+	case FirewallIPTables, FirewallNFTables, FirewallIPSet:
+	default:
+		return nil, fmt.Errorf("unknown firewall %q", o.firewall)
+	}
+	if len(o.ladder) == 0 {
+		return nil, errors.New("ban ladder must have at least one duration")
+	}
+	if o.findTime <= 0 {
+		return nil, fmt.Errorf("ban find time %v must be positive", o.findTime)
+	}
+	for _, d := range o.ladder {
+		if d < 0 {
+			return nil, fmt.Errorf("ban ladder duration %v is negative", d)
+		}
+	}
+	return o, nil
+}
+
+// capture returns what the capturer captures, configured by o.
+func (o *options) capture() captureConfig {
+	return captureConfig{udp: o.udp, stealth: o.stealth, icmp: o.pingScan(), sctp: o.sctp, answers: o.unanswered}
+}
+
+// pingScan returns true when ping scan detection is enabled.
+func (o *options) pingScan() bool {
+	return o.pingScanHosts > 0 || o.pingScanPackets > 0
+}
+
+// blocklist returns a blocklist for firewall configured by o.
+func (o *options) blocklist(firewall BlockCloser) *blocklist {
+	b := newBlocklist(firewall, o.ladder, o.evaluationInterval)
+	b.findTime = o.findTime
+	return b
+}
+
+// tracker returns a Tracker configured by o.
+func (o *options) tracker() *Tracker {
+	t := newTracker(o.trackerEntryTTL, o.evaluationInterval, o.minimumPortScanned)
+	t.key = o.key
+	t.unanswered = o.unanswered
+	t.weights = o.portWeights
+	t.listeningWeight = o.listeningWeight
+	t.os = o.osDatabase
+	return t
+}
+
+// stealthTracker returns a Tracker for stealth scans configured by o, or nil
+// when stealth scan detection is disabled.
+func (o *options) stealthTracker() *Tracker {
+	if !o.stealth {
+		return nil
+	}
+	// Every probe is detected on the first one, so ports aren't weighted.
+	if o.stealthFirstProbe {
+		t := newStealthTracker(o.trackerEntryTTL, o.evaluationInterval, 0)
+		t.key = o.key
+		t.os = o.osDatabase
+		return t
+	}
+	t := newStealthTracker(o.trackerEntryTTL, o.evaluationInterval, o.minimumPortScanned)
+	t.key = o.key
+	t.weights = o.portWeights
+	t.listeningWeight = o.listeningWeight
+	t.os = o.osDatabase
+	return t
+}
+
+// sweepTracker returns a sweepTracker configured by o, or nil when sweep
+// detection is disabled.
+func (o *options) sweepTracker() *sweepTracker {
+	if o.minimumHostsScanned == 0 {
+		return nil
+	}
+	t := newSweepTracker(o.trackerEntryTTL, o.evaluationInterval, o.minimumHostsScanned)
+	t.os = o.osDatabase
+	return t
+}
+
+// slowTracker returns a slowTracker configured by o, or nil when low-and-slow
+// detection is disabled. Sources are grouped by prefix with AggregatePrefix,
+// otherwise by IP.
+func (o *options) slowTracker() *slowTracker {
+	if o.slowScanThreshold == 0 {
+		return nil
+	}
+	v4Bits, v6Bits := 8*net.IPv4len, 8*net.IPv6len
+	if o.aggregation == AggregatePrefix {
+		v4Bits, v6Bits = o.prefixV4, o.prefixV6
+	}
+	return newSlowTracker(o.slowScanHorizon, o.evaluationInterval, o.slowScanThreshold, v4Bits, v6Bits)
+}
+
+// distributedTracker returns a distributedTracker configured by o, or nil
+// when distributed scan detection is disabled.
+func (o *options) distributedTracker() *distributedTracker {
+	if o.distributedScanThreshold == 0 {
+		return nil
+	}
+	return newDistributedTracker(o.distributedScanWindow, o.evaluationInterval, o.distributedScanThreshold, o.servicePorts, o.blockDistributedScans)
+}
+
+// toolTracker returns a toolTracker configured by o, or nil when sources
+// aren't blocked on a single SYN from a scanning tool.
+func (o *options) toolTracker() *toolTracker {
+	if !o.blockTools {
+		return nil
+	}
+	return newToolTracker(o.trackerEntryTTL, o.evaluationInterval)
+}
+
+// listeningPorts returns the ports the host is listening on, refreshed as
+// configured by o, or nil when they aren't exempted.
+func (o *options) listeningPorts() *listeningPorts {
+	if !o.listening {
+		return nil
+	}
+	return newListeningPorts(procNetDir, o.listeningRefresh)
+}
+
+// tripwireTracker returns a tripwireTracker configured by o, or nil when
+// there are no tripwire ports.
+func (o *options) tripwireTracker() *tripwireTracker {
+	if len(o.tripwirePorts) == 0 {
+		return nil
+	}
+	return newTripwireTracker(o.tripwirePorts, o.trackerEntryTTL, o.evaluationInterval, o.blockSpoofableTripwires)
+}
+
+// pingTracker returns a pingTracker configured by o, or nil when ping scan
+// detection is disabled.
+func (o *options) pingTracker() *pingTracker {
+	if !o.pingScan() {
+		return nil
+	}
+	return newPingTracker(o.pingScanWindow, o.evaluationInterval, o.pingScanHosts, o.pingScanPackets)
+}
+
+// newDetectors returns every enabled Detector configured by o, followed by
+// those added with WithDetectors. When packetClock is set the built in
+// Detectors tell time by the connections added, see Tracker.
+func (o *options) newDetectors(packetClock bool) []Detector {
+	// A capture is rarely replayed on the host it was taken on, so the ports
+	// this host is listening on don't apply.
+	var listening *listeningPorts
+	if !packetClock {
+		listening = o.listeningPorts()
+	}
+	t := o.tracker()
+	t.packetClock = packetClock
+	t.listening = listening
+	detectors := []Detector{t}
+	if st := o.stealthTracker(); st != nil {
+		st.packetClock = packetClock
+		if !o.stealthFirstProbe {
+			st.listening = listening
+		}
+		detectors = append(detectors, st)
+	}
+	if sw := o.sweepTracker(); sw != nil {
+		sw.packetClock = packetClock
+		detectors = append(detectors, sw)
+	}
+	if sl := o.slowTracker(); sl != nil {
+		sl.packetClock = packetClock
+		detectors = append(detectors, sl)
+	}
+	if d := o.distributedTracker(); d != nil {
+		d.packetClock = packetClock
+		d.listening = listening
+		detectors = append(detectors, d)
+	}
+	if tw := o.tripwireTracker(); tw != nil {
+		tw.packetClock = packetClock
+		detectors = append(detectors, tw)
+	}
+	if tt := o.toolTracker(); tt != nil {
+		tt.packetClock = packetClock
+		detectors = append(detectors, tt)
+	}
+	if p := o.pingTracker(); p != nil {
+		p.packetClock = packetClock
+		detectors = append(detectors, p)
+	}
+	return append(detectors, o.detectors...)
+}
+
+// WithMinimumPortScanned sets how many distinct ports a source can connect to
+// before it is considered a port scanner, the default is 3. Connecting to
+// more than n ports is a port scan. When ports are weighted, see
+// WithPortWeights, n is the score the ports must add up to more than.
+func WithMinimumPortScanned(n int) Option {
+	return func(o *options) {
+		o.minimumPortScanned = n
+	}
+}
+
+// WithMinimumHostsScanned sets how many hosts a source can connect to the same
+// port on before it's considered to be sweeping, it's disabled by default.
+// Connecting to more than n hosts is a sweep, and an n of 0 disables sweep
+// detection. Hosts are counted within the tracker entry TTL.
+func WithMinimumHostsScanned(n int) Option {
+	return func(o *options) {
+		o.minimumHostsScanned = n
+	}
+}
+
+// WithTrackerEntryTTL sets how long connections are tracked for, the default
+// is 1 minute. Port scans are detected within this window.
+func WithTrackerEntryTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.trackerEntryTTL = d
+	}
+}
+
+// WithEvaluationInterval sets how often expired entries and blocks are
+// removed, the default is 1 second. It must not be longer than the tracker
+// entry TTL.
+func WithEvaluationInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.evaluationInterval = d
+	}
+}
+
+// WithAggregation sets how connections are grouped together when counting the
+// ports scanned, the default is AggregateSrcDst.
+func WithAggregation(a Aggregation) Option {
+	return func(o *options) {
+		o.aggregation = a
+	}
+}
+
+// WithSourcePrefix sets the prefix lengths used by AggregatePrefix for IPv4
+// and IPv6 sources, the default is a /24 and a /64.
+func WithSourcePrefix(v4Bits, v6Bits int) Option {
+	return func(o *options) {
+		o.prefixV4, o.prefixV6 = v4Bits, v6Bits
+	}
+}
+
+// WithSlowScan sets how many distinct ports a source can connect to within
+// horizon before it's considered a low-and-slow port scanner, it's disabled by
+// default and the default horizon is 6 hours. Connecting to more than n ports
+// is a port scan, and an n of 0 disables low-and-slow detection. The horizon
+// must be longer than the tracker entry TTL.
+func WithSlowScan(n int, horizon time.Duration) Option {
+	return func(o *options) {
+		o.slowScanThreshold, o.slowScanHorizon = n, horizon
+	}
+}
+
+// WithDistributedScan enables detecting distributed port scans, where more
+// than n distinct sources connect to ports other than the service ports
+// within window (eg. 50 sources within 30 seconds). It's disabled by default,
+// see WithServicePorts.
+func WithDistributedScan(n int, window time.Duration) Option {
+	return func(o *options) {
+		o.distributedScanThreshold, o.distributedScanWindow = n, window
+	}
+}
+
+// WithDistributedScanBlocking blocks every source taking part in a
+// distributed port scan, by default they are only logged.
+func WithDistributedScanBlocking() Option {
+	return func(o *options) {
+		o.blockDistributedScans = true
+	}
+}
+
+// WithServicePorts sets the ports that are expected to be connected to, such
+// as 80 and 443 on a web server. Connections to them don't count towards a
+// distributed port scan. With WithListeningPorts the ports the host is
+// listening on don't count either, so these are only needed for ports that
+// are served elsewhere, such as those forwarded by a router.
+func WithServicePorts(ports ...int) Option {
+	return func(o *options) {
+		o.servicePorts = append(o.servicePorts, ports...)
+	}
+}
+
+// WithUDP captures inbound UDP datagrams, and the ICMP port unreachable
+// replies the host sends back to them, so that UDP port scans are detected
+// too. UDP ports are counted separately from TCP ones. Replies to the
+// datagrams the host sends, and datagrams to ephemeral ports, aren't counted.
+// By default only TCP SYNs are captured.
+func WithUDP() Option {
+	return func(o *options) {
+		o.udp = true
+	}
+}
+
+// WithSCTP captures SCTP INITs, so that SCTP port scans (eg. nmap -sY) are
+// detected too. SCTP ports are counted separately from TCP ones, in the same
+// way. By default only TCP SYNs are captured.
+func WithSCTP() Option {
+	return func(o *options) {
+		o.sctp = true
+	}
+}
+
+// WithUnansweredSYNs also captures the SYN-ACKs and RSTs the host answers
+// SYNs with, and only counts the ports of SYNs whose connection attempt
+// failed, that were answered with a RST or not answered at all, towards the
+// minimum ports scanned. Clients of several open services are then never
+// port scanners, as scans mostly probe closed ports. When replaying, the SYNs
+// still waiting on an answer at the end of the capture are counted. By
+// default every SYN is counted.
+func WithUnansweredSYNs() Option {
+	return func(o *options) {
+		o.unanswered = true
+	}
+}
+
+// WithStealthScan captures stealth probes, TCP packets without the SYN, ACK
+// or RST flags such as FIN, NULL and XMAS packets, and detects sources that
+// send them to more than the minimum ports scanned as stealth scans. By
+// default only TCP SYNs are captured.
+func WithStealthScan() Option {
+	return func(o *options) {
+		o.stealth = true
+	}
+}
+
+// WithStealthScanFirstProbe detects, and so blocks, a source on the first
+// stealth probe it sends, rather than once it has probed more than the minimum
+// ports scanned. It implies WithStealthScan.
+func WithStealthScanFirstProbe() Option {
+	return func(o *options) {
+		o.stealth, o.stealthFirstProbe = true, true
+	}
+}
+
+// WithToolFingerprintBlocking blocks a source on a single SYN that was sent
+// by a scanning tool, such as masscan or zmap, with high confidence. Scans are
+// always labelled with the tool that likely sent them, but by default they
+// are only detected once they cross a threshold.
+func WithToolFingerprintBlocking() Option {
+	return func(o *options) {
+		o.blockTools = true
+	}
+}
+
+// WithOSSignatures guesses the operating system, and hop distance, of port
+// scanners by matching their SYNs against db, see ReadOSSignatures. The guess
+// is attached to each TrackerEntry.
+func WithOSSignatures(db *OSDatabase) Option {
+	return func(o *options) {
+		o.osDatabase = db
+	}
+}
+
+// WithPingScan enables detecting ping sweeps and floods, where a source sends
+// ICMP echo requests (or ICMPv6 echo requests and neighbour solicitations) to
+// more than hosts hosts, or sends more than packets echo requests, within
+// window (eg. 10 hosts or 100 packets within 10 seconds). A hosts or packets of 0
+// disables that check, it's disabled by default.
+func WithPingScan(hosts, packets int, window time.Duration) Option {
+	return func(o *options) {
+		o.pingScanHosts, o.pingScanPackets, o.pingScanWindow = hosts, packets, window
+	}
+}
+
+// WithPortWeights sets what connecting to each port of protocol scores
+// towards the minimum ports scanned, ports that aren't weighted score 1.
+// Served ports can be weighted lower, and closed or sensitive ports higher, so
+// that a source hitting a few sensitive ports is a port scanner while a client
+// of the served ones isn't. A weight of 0 never counts the port. Weights don't
+// apply to WithStealthScanFirstProbe, which detects every stealth probe.
+func WithPortWeights(protocol Protocol, weights map[int]int) Option {
+	return func(o *options) {
+		if o.portWeights == nil {
+			o.portWeights = make(map[Protocol]map[int]int)
+		}
+		if o.portWeights[protocol] == nil {
+			o.portWeights[protocol] = make(map[int]int)
+		}
+		for p, w := range weights {
+			o.portWeights[protocol][p] = w
+		}
+	}
+}
+
+// WithListeningPorts exempts the TCP and UDP ports the host is listening on,
+// read from /proc/net every refresh, so that clients of several of its
+// services aren't blocked. Connecting to a listening port scores weight
+// towards the minimum ports scanned rather than 1, a weight of 0 never counts
+// it. Ports weighted with WithPortWeights keep their weight, and connections
+// to listening ports aren't part of a distributed port scan. Listening ports
+// aren't exempted when replaying a packet capture.
+func WithListeningPorts(weight int, refresh time.Duration) Option {
+	return func(o *options) {
+		o.listening = true
+		o.listeningWeight = weight
+		o.listeningRefresh = refresh
+	}
+}
+
+// WithTripwirePorts sets ports that nothing legitimate ever connects to, such
+// as 23, 445 and 3389 on a Linux host. A single connection to one of them is
+// detected, and so blocked, whatever the minimum ports scanned. UDP and SCTP
+// tripwires are only logged, see WithSpoofableTripwireBlocking.
+func WithTripwirePorts(ports ...int) Option {
+	return func(o *options) {
+		o.tripwirePorts = append(o.tripwirePorts, ports...)
+	}
+}
+
+// WithSpoofableTripwireBlocking blocks the sources of UDP and SCTP tripwires
+// too. A single datagram or INIT trips one, and its source address can be
+// spoofed to get any address (eg. the gateway) blocked, so by default they're
+// only logged.
+func WithSpoofableTripwireBlocking() Option {
+	return func(o *options) {
+		o.blockSpoofableTripwires = true
+	}
+}
+
+// WithDetectors adds detectors to run alongside the built in ones, their
+// Detections are blocked (and logged) in the same way. The Engine closes them
+// when it's closed.
+func WithDetectors(detectors ...Detector) Option {
+	return func(o *options) {
+		o.detectors = append(o.detectors, detectors...)
+	}
+}
+
+// WithFirewall selects the firewall used to block port scanners, the default
+// is FirewallIPTables.
+func WithFirewall(f Firewall) Option {
+	return func(o *options) {
+		o.firewall = f
+	}
+}
+
+// WithBlockDuration sets how long port scanners are blocked for, the default is
+// 1 hour. A duration of 0 blocks them until the engine is closed.
+func WithBlockDuration(d time.Duration) Option {
+	return WithBanLadder(d)
+}
+
+// WithBanLadder sets how long port scanners are blocked for each time they are
+// caught again after their previous block expired, eg. 10m, 1h, 24h, 0. The
+// last duration is used for every offence after that, a duration of 0 blocks
+// them until the engine is closed.
+func WithBanLadder(ladder ...time.Duration) Option {
+	return func(o *options) {
+		o.ladder = ladder
+	}
+}
+
+// WithBanFindTime sets how long an IP stays a repeat offender after its block
+// expired, the default is 24 hours. An IP that isn't caught again within d is
+// forgotten, so its next block starts at the bottom of the ban ladder.
+func WithBanFindTime(d time.Duration) Option {
+	return func(o *options) {
+		o.findTime = d
+	}
+}
+
+// WithAllowlist adds networks whose source IPs are never blocked, port scans
+// from them are still tracked and logged.
+func WithAllowlist(nets ...*net.IPNet) Option {
+	return func(o *options) {
+		o.allowlist = append(o.allowlist, nets...)
+	}
+}
+
+// WithDryRun stops the engine from touching the host firewall, port scanners
+// are logged and counted as if they were blocked. The firewall passed to
+// WithFirewall is never set up, so the engine doesn't need CAP_NET_ADMIN.
+func WithDryRun() Option {
+	return func(o *options) {
+		o.dryRun = true
+	}
+}
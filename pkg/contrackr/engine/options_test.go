@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewOptions(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		opts    []Option
+		wantErr bool
+	}{
+		{
+			desc: "test defaults are valid",
+		},
+		{
+			desc: "test tuned thresholds are valid",
+			opts: []Option{WithMinimumPortScanned(10), WithTrackerEntryTTL(5 * time.Minute), WithEvaluationInterval(10 * time.Second)},
+		},
+		{
+			desc:    "test evaluation interval longer than TTL is an error",
+			opts:    []Option{WithTrackerEntryTTL(time.Second), WithEvaluationInterval(time.Minute)},
+			wantErr: true,
+		},
+		{
+			desc:    "test zero minimum ports scanned is an error",
+			opts:    []Option{WithMinimumPortScanned(0)},
+			wantErr: true,
+		},
+		{
+			desc: "test disabling sweep detection is valid",
+			opts: []Option{WithMinimumHostsScanned(0)},
+		},
+		{
+			desc:    "test negative minimum hosts scanned is an error",
+			opts:    []Option{WithMinimumHostsScanned(-1)},
+			wantErr: true,
+		},
+		{
+			desc:    "test zero TTL is an error",
+			opts:    []Option{WithTrackerEntryTTL(0)},
+			wantErr: true,
+		},
+		{
+			desc:    "test negative evaluation interval is an error",
+			opts:    []Option{WithEvaluationInterval(-time.Second)},
+			wantErr: true,
+		},
+		{
+			desc: "test prefix aggregation is valid",
+			opts: []Option{WithAggregation(AggregatePrefix), WithSourcePrefix(16, 48)},
+		},
+		{
+			desc:    "test unknown aggregation is an error",
+			opts:    []Option{WithAggregation("dst")},
+			wantErr: true,
+		},
+		{
+			desc:    "test IPv4 prefix longer than an address is an error",
+			opts:    []Option{WithAggregation(AggregatePrefix), WithSourcePrefix(33, 64)},
+			wantErr: true,
+		},
+		{
+			desc: "test disabling slow scan detection ignores the horizon",
+			opts: []Option{WithSlowScan(0, 0)},
+		},
+		{
+			desc:    "test slow scan horizon within the TTL is an error",
+			opts:    []Option{WithTrackerEntryTTL(time.Hour), WithSlowScan(20, time.Hour)},
+			wantErr: true,
+		},
+		{
+			desc: "test distributed scan detection is valid",
+			opts: []Option{WithDistributedScan(50, 30*time.Second), WithDistributedScanBlocking(), WithServicePorts(80, 443)},
+		},
+		{
+			desc:    "test out of range service port is an error",
+			opts:    []Option{WithServicePorts(0)},
+			wantErr: true,
+		},
+		{
+			desc:    "test unknown firewall is an error",
+			opts:    []Option{WithFirewall("pf")},
+			wantErr: true,
+		},
+		{
+			desc:    "test unknown firewall is an error on a dry run",
+			opts:    []Option{WithFirewall("pf"), WithDryRun()},
+			wantErr: true,
+		},
+		{
+			desc:    "test zero ban find time is an error",
+			opts:    []Option{WithBanFindTime(0)},
+			wantErr: true,
+		},
+		{
+			desc: "test port weights are valid",
+			opts: []Option{WithPortWeights(ProtocolTCP, map[int]int{80: 0, 22: 2}), WithPortWeights(ProtocolUDP, map[int]int{53: 0})},
+		},
+		{
+			desc:    "test negative port weight is an error",
+			opts:    []Option{WithPortWeights(ProtocolTCP, map[int]int{22: -1})},
+			wantErr: true,
+		},
+		{
+			desc:    "test out of range weighted port is an error",
+			opts:    []Option{WithPortWeights(ProtocolTCP, map[int]int{0: 2})},
+			wantErr: true,
+		},
+		{
+			desc:    "test weighted ICMP is an error",
+			opts:    []Option{WithPortWeights(ProtocolICMP, map[int]int{1: 0})},
+			wantErr: true,
+		},
+		{
+			desc: "test listening ports are valid",
+			opts: []Option{WithListeningPorts(0, 30*time.Second)},
+		},
+		{
+			desc:    "test negative listening port weight is an error",
+			opts:    []Option{WithListeningPorts(-1, 30*time.Second)},
+			wantErr: true,
+		},
+		{
+			desc:    "test zero listening port refresh is an error",
+			opts:    []Option{WithListeningPorts(0, 0)},
+			wantErr: true,
+		},
+		{
+			desc: "test counting unanswered SYNs is valid",
+			opts: []Option{WithUnansweredSYNs()},
+		},
+		{
+			desc: "test tripwire ports are valid",
+			opts: []Option{WithTripwirePorts(23, 445, 3389)},
+		},
+		{
+			desc:    "test out of range tripwire port is an error",
+			opts:    []Option{WithTripwirePorts(65536)},
+			wantErr: true,
+		},
+		{
+			desc: "test ping scan detection is valid",
+			opts: []Option{WithPingScan(10, 0, 10*time.Second)},
+		},
+		{
+			desc:    "test negative ping scan packets is an error",
+			opts:    []Option{WithPingScan(10, -1, 10*time.Second)},
+			wantErr: true,
+		},
+		{
+			desc:    "test zero ping scan window is an error",
+			opts:    []Option{WithPingScan(0, 100, 0)},
+			wantErr: true,
+		},
+		{
+			desc:    "test empty ban ladder is an error",
+			opts:    []Option{WithBanLadder()},
+			wantErr: true,
+		},
+		{
+			desc:    "test negative block duration is an error",
+			opts:    []Option{WithBanLadder(time.Hour, -time.Hour)},
+			wantErr: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, err := newOptions(tC.opts)
+			if (err != nil) != tC.wantErr {
+				t.Errorf("newOptions() returned err=%v, want err=%t", err, tC.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// maxHopDistance is the furthest a source can be from its initial TTL to
+// match a signature, as in p0f.
+const maxHopDistance = 35
+
+// OSGuess is the operating system that likely sent a SYN, and how many hops
+// away it is.
+type OSGuess struct {
+	OS       string
+	Distance int
+}
+
+// String returns the operating system and distance of g.
+func (g *OSGuess) String() string {
+	return fmt.Sprintf("%s, %d hops away", g.OS, g.Distance)
+}
+
+// windowSpec is how a signature matches the window size.
+type windowSpec struct {
+	// kind is one of "*" (any), "=" (exactly n), "mss" or "mtu" (a multiple
+	// n of the MSS or MTU) or "%" (any multiple of n).
+	kind string
+	n    int
+}
+
+// matches returns true when window w, sent with h, matches the spec. The MTU
+// is derived from the MSS and the IP version.
+func (s windowSpec) matches(w int, h *SYNHeader, v4 bool) bool {
+	switch s.kind {
+	case "*":
+		return true
+	case "=":
+		return w == s.n
+	case "mss":
+		return h.MSS != 0 && w == int(h.MSS)*s.n
+	case "mtu":
+		mtu := int(h.MSS) + 60
+		if v4 {
+			mtu = int(h.MSS) + 40
+		}
+		return h.MSS != 0 && w == mtu*s.n
+	case "%":
+		return s.n != 0 && w%s.n == 0
+	}
+	return false
+}
+
+// osSignature is a p0f TCP SYN signature.
+type osSignature struct {
+	os string
+	// version is 4 or 6, or 0 for either.
+	version int
+	ittl    int
+	// mss is -1 for any.
+	mss    int
+	window windowSpec
+	layout []layers.TCPOptionKind
+}
+
+// OSDatabase is the signatures SYNs are matched against to guess the
+// operating system that sent them, see ReadOSSignatures.
+type OSDatabase struct {
+	sigs []osSignature
+}
+
+// Match returns the operating system that likely sent v, from the first
+// signature that matches its header, or nil if none do.
+func (db *OSDatabase) Match(v *Connection) *OSGuess {
+	h := v.Header
+	if db == nil || h == nil {
+		return nil
+	}
+	v4 := v.Src.IP.To4() != nil
+	for _, s := range db.sigs {
+		if (s.version == 4 && !v4) || (s.version == 6 && v4) {
+			continue
+		}
+		if int(h.TTL) > s.ittl || s.ittl-int(h.TTL) > maxHopDistance {
+			continue
+		}
+		if s.mss >= 0 && int(h.MSS) != s.mss {
+			continue
+		}
+		if !s.window.matches(int(h.Window), h, v4) || !sameLayout(s.layout, h.Options) {
+			continue
+		}
+		return &OSGuess{OS: s.os, Distance: s.ittl - int(h.TTL)}
+	}
+	return nil
+}
+
+// sameLayout returns true when a and b are the same options in the same
+// order.
+func sameLayout(a, b []layers.TCPOptionKind) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// osLayoutOptions are the TCP options named in a p0f option layout.
+var osLayoutOptions = map[string]layers.TCPOptionKind{
+	"nop":  layers.TCPOptionKindNop,
+	"mss":  layers.TCPOptionKindMSS,
+	"ws":   layers.TCPOptionKindWindowScale,
+	"sok":  layers.TCPOptionKindSACKPermitted,
+	"sack": layers.TCPOptionKindSACK,
+	"ts":   layers.TCPOptionKindTimestamps,
+}
+
+// ReadOSSignatures reads the TCP SYN signatures from a p0f (version 3)
+// fingerprint database, such as p0f.fp. Only the [tcp:request] section is
+// read, and of each signature only the IP version, initial TTL, MSS, window
+// size and option layout are matched. The window scale, quirks and payload
+// class are ignored. Lines starting with ; are comments.
+func ReadOSSignatures(r io.Reader) (*OSDatabase, error) {
+	db := &OSDatabase{}
+	var section, label string
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+		if section != "[tcp:request]" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: expected key = value, got %q", n, line)
+		}
+		switch k, v := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); k {
+		case "label":
+			var err error
+			if label, err = parseOSLabel(v); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+		case "sig":
+			if label == "" {
+				return nil, fmt.Errorf("line %d: signature without a label", n)
+			}
+			sig, err := parseOSSignature(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			sig.os = label
+			db.sigs = append(db.sigs, sig)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// parseOSLabel returns the operating system named by a p0f label, such as
+// "s:unix:Linux:3.11 and newer".
+func parseOSLabel(v string) (string, error) {
+	f := strings.SplitN(v, ":", 4)
+	if len(f) != 4 {
+		return "", fmt.Errorf("invalid label %q", v)
+	}
+	if f[3] == "" {
+		return f[2], nil
+	}
+	return f[2] + " " + f[3], nil
+}
+
+// parseOSSignature parses a p0f TCP signature, such as
+// "*:64:0:*:mss*20,10:mss,sok,ts,nop,ws:df,id+:0".
+func parseOSSignature(v string) (osSignature, error) {
+	var sig osSignature
+	f := strings.Split(v, ":")
+	if len(f) != 8 {
+		return sig, fmt.Errorf("signature %q has %d fields, want 8", v, len(f))
+	}
+	switch f[0] {
+	case "*":
+	case "4":
+		sig.version = 4
+	case "6":
+		sig.version = 6
+	default:
+		return sig, fmt.Errorf("invalid IP version %q", f[0])
+	}
+	// The initial TTL may be followed by "-" for a bad TTL, or "+" and the
+	// distance.
+	ittl, err := strconv.Atoi(strings.TrimRight(strings.SplitN(f[1], "+", 2)[0], "-"))
+	if err != nil {
+		return sig, fmt.Errorf("invalid initial TTL %q", f[1])
+	}
+	sig.ittl = ittl
+	sig.mss = -1
+	if f[3] != "*" {
+		if sig.mss, err = strconv.Atoi(f[3]); err != nil {
+			return sig, fmt.Errorf("invalid MSS %q", f[3])
+		}
+	}
+	if sig.window, err = parseWindowSpec(strings.SplitN(f[4], ",", 2)[0]); err != nil {
+		return sig, err
+	}
+	if f[5] != "" {
+		for _, o := range strings.Split(f[5], ",") {
+			// The end of options (eg. eol+1) isn't captured in the
+			// SYNHeader.
+			if strings.HasPrefix(o, "eol") {
+				continue
+			}
+			kind, ok := osLayoutOptions[o]
+			// Other options are given by their kind, eg. ?30.
+			if n, err := strconv.ParseUint(strings.TrimPrefix(o, "?"), 10, 8); !ok && strings.HasPrefix(o, "?") && err == nil {
+				kind, ok = layers.TCPOptionKind(n), true
+			}
+			if !ok {
+				return sig, fmt.Errorf("invalid option %q", o)
+			}
+			sig.layout = append(sig.layout, kind)
+		}
+	}
+	return sig, nil
+}
+
+// parseWindowSpec parses the window size of a p0f signature, such as "*",
+// "8192", "mss*20", "mtu*4" or "%8192".
+func parseWindowSpec(v string) (windowSpec, error) {
+	var s windowSpec
+	var err error
+	switch {
+	case v == "*":
+		s.kind = "*"
+	case strings.HasPrefix(v, "mss*"):
+		s.kind = "mss"
+		s.n, err = strconv.Atoi(v[len("mss*"):])
+	case strings.HasPrefix(v, "mtu*"):
+		s.kind = "mtu"
+		s.n, err = strconv.Atoi(v[len("mtu*"):])
+	case strings.HasPrefix(v, "%"):
+		s.kind = "%"
+		s.n, err = strconv.Atoi(v[1:])
+	default:
+		s.kind = "="
+		s.n, err = strconv.Atoi(v)
+	}
+	if err != nil {
+		return s, fmt.Errorf("invalid window size %q", v)
+	}
+	return s, nil
+}
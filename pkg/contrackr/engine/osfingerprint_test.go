@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/gopacket/layers"
+)
+
+// readOSSignatures returns the signatures in testdata/p0f.fp.
+func readOSSignatures(t *testing.T) *OSDatabase {
+	t.Helper()
+	f, err := os.Open("testdata/p0f.fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	db, err := ReadOSSignatures(f)
+	if err != nil {
+		t.Fatalf("ReadOSSignatures() returned err=%v, want nil error", err)
+	}
+	return db
+}
+
+func TestReadOSSignatures(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		in      string
+		wantErr bool
+	}{
+		{
+			desc: "test other sections are ignored",
+			in:   "[mtu]\nlabel = Ethernet\nsig = 1500\n[tcp:request]\nlabel = s:unix:Linux:\nsig = 4:64:0:*:mss*10,0:eol+1,mss,?30:df:0\n",
+		},
+		{
+			desc:    "test signature without a label is an error",
+			in:      "[tcp:request]\nsig = *:64:0:*:mss*20,10:mss,sok,ts,nop,ws:df,id+:0\n",
+			wantErr: true,
+		},
+		{
+			desc:    "test signature with missing fields is an error",
+			in:      "[tcp:request]\nlabel = s:unix:Linux:3.x\nsig = *:64:0:*:mss*20,10\n",
+			wantErr: true,
+		},
+		{
+			desc:    "test signature with an unknown option is an error",
+			in:      "[tcp:request]\nlabel = s:unix:Linux:3.x\nsig = *:64:0:*:mss*20,10:mss,foo:df:0\n",
+			wantErr: true,
+		},
+		{
+			desc:    "test signature with an invalid window size is an error",
+			in:      "[tcp:request]\nlabel = s:unix:Linux:3.x\nsig = *:64:0:*:mss*x,10:mss:df:0\n",
+			wantErr: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			_, err := ReadOSSignatures(strings.NewReader(tC.in))
+			if (err != nil) != tC.wantErr {
+				t.Errorf("ReadOSSignatures() returned err=%v, want err=%t", err, tC.wantErr)
+			}
+		})
+	}
+}
+
+func TestOSMatch(t *testing.T) {
+	db := readOSSignatures(t)
+	linux := []layers.TCPOptionKind{
+		layers.TCPOptionKindMSS,
+		layers.TCPOptionKindSACKPermitted,
+		layers.TCPOptionKindTimestamps,
+		layers.TCPOptionKindNop,
+		layers.TCPOptionKindWindowScale,
+	}
+	windows := []layers.TCPOptionKind{
+		layers.TCPOptionKindMSS,
+		layers.TCPOptionKindNop,
+		layers.TCPOptionKindWindowScale,
+		layers.TCPOptionKindNop,
+		layers.TCPOptionKindNop,
+		layers.TCPOptionKindSACKPermitted,
+	}
+	testCases := []struct {
+		desc string
+		in   *SYNHeader
+		want *OSGuess
+	}{
+		{
+			desc: "test linux is matched",
+			in:   &SYNHeader{TTL: 64, Window: 64240, Options: linux, MSS: 1460},
+			want: &OSGuess{OS: "Linux 3.11 and newer", Distance: 0},
+		},
+		{
+			desc: "test windows is matched with its distance",
+			in:   &SYNHeader{TTL: 120, Window: 8192, Options: windows, MSS: 1460},
+			want: &OSGuess{OS: "Windows 7 or 8", Distance: 8},
+		},
+		{
+			desc: "test nmap is matched",
+			in:   &SYNHeader{TTL: 50, Window: 2048, Options: []layers.TCPOptionKind{layers.TCPOptionKindMSS}, MSS: 1460},
+			want: &OSGuess{OS: "NMap SYN scan", Distance: 14},
+		},
+		{
+			desc: "test TTL above the initial TTL isn't matched",
+			in:   &SYNHeader{TTL: 100, Window: 64240, Options: linux, MSS: 1460},
+		},
+		{
+			desc: "test window that isn't a multiple of the MSS isn't matched",
+			in:   &SYNHeader{TTL: 64, Window: 26823, Options: linux, MSS: 8941},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			c := conn(net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191"), 22)
+			c.Header = tC.in
+			if diff := cmp.Diff(tC.want, db.Match(c)); diff != "" {
+				t.Errorf("Match() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTrackerGuessesOS(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	tkr := newTracker(time.Minute, time.Hour, 1)
+	tkr.os = readOSSignatures(t)
+	c := conn(srcIP, dstIP, 80)
+	c.Header = &SYNHeader{TTL: 50, Window: 1024, Options: []layers.TCPOptionKind{layers.TCPOptionKindMSS}, MSS: 1460}
+	var got []string
+	for _, d := range collect(tkr, []*Connection{conn(srcIP, dstIP, 22), c}) {
+		got = append(got, d.Evidence.String())
+	}
+	want := []string{"192.168.86.158 -> 192.168.86.191 on ports [22 80] (likely nmap; NMap SYN scan, 14 hops away)"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,241 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// bpfPingFilter is the BPF filter that is used to capture ICMP echo requests,
+// and ICMPv6 echo requests (type 128) and neighbour solicitations (type 135).
+// Like bpfFilter, the ICMPv6 type has to be matched directly after the IPv6
+// header.
+const bpfPingFilter = `icmp[icmptype] = icmp-echo
+or (icmp6 and (ip6[40] = 128 or ip6[40] = 135))`
+
+// ping returns the echo request or neighbour solicitation in packet, or nil if
+// it isn't one. Neighbour solicitations are sent to a multicast address, so
+// the Dst is the address being solicited. The ports are always zero.
+func ping(packet gopacket.Packet) *Connection {
+	c := &Connection{
+		Protocol: ProtocolICMP,
+		Src:      &net.TCPAddr{},
+		Dst:      &net.TCPAddr{},
+		Time:     packet.Metadata().Timestamp,
+	}
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+		icmp, _ := icmpLayer.(*layers.ICMPv4)
+		if icmp.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+			return nil
+		}
+		ipv4Layer := packet.Layer(layers.LayerTypeIPv4)
+		if ipv4Layer == nil {
+			return nil
+		}
+		ip4, _ := ipv4Layer.(*layers.IPv4)
+		c.Src.IP = ip4.SrcIP
+		c.Dst.IP = ip4.DstIP
+		return c
+	}
+	if icmpLayer := packet.Layer(layers.LayerTypeICMPv6); icmpLayer != nil {
+		icmp, _ := icmpLayer.(*layers.ICMPv6)
+		ipv6Layer := packet.Layer(layers.LayerTypeIPv6)
+		if ipv6Layer == nil {
+			return nil
+		}
+		ip6, _ := ipv6Layer.(*layers.IPv6)
+		c.Src.IP = ip6.SrcIP
+		c.Dst.IP = ip6.DstIP
+		switch icmp.TypeCode.Type() {
+		case layers.ICMPv6TypeEchoRequest:
+			return c
+		case layers.ICMPv6TypeNeighborSolicitation:
+			nsLayer := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation)
+			// Duplicate address detection is solicited from the
+			// unspecified address, and isn't a probe.
+			if nsLayer == nil || ip6.SrcIP.IsUnspecified() {
+				return nil
+			}
+			ns, _ := nsLayer.(*layers.ICMPv6NeighborSolicitation)
+			c.Dst.IP = ns.TargetAddress
+			c.Solicitation = true
+			return c
+		}
+	}
+	return nil
+}
+
+// maxPingDstIPs caps how many destination IPs are remembered for each source,
+// so that sweeps of large prefixes stay bounded.
+const maxPingDstIPs = 256
+
+// PingScan is a source that sent too many echo requests (or neighbour
+// solicitations) within the window, to too many hosts or in total.
+type PingScan struct {
+	SrcIP *net.IP
+	// DstIPs are the distinct hosts probed, in the order they were first
+	// probed.
+	DstIPs []*net.IP
+	// Packets is how many echo requests were sent.
+	Packets   int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// String returns the source, hosts and packets of s.
+func (s *PingScan) String() string {
+	return fmt.Sprintf("%s -> %d hosts (%s) in %d packets", s.SrcIP, len(s.DstIPs), ipList(s.DstIPs), s.Packets)
+}
+
+// pingEntry is a source's probes within the current window.
+type pingEntry struct {
+	scan     PingScan
+	seen     map[string]bool
+	reported bool
+}
+
+// pingTracker is the Detector for ping sweeps and floods, where a source
+// sends echo requests or neighbour solicitations to more than minimumHosts
+// hosts, or sends more than maximumPackets echo requests, within the window.
+// Neighbours routinely solicit the host's own addresses (eg. a router checking
+// it's still reachable), so solicitations aren't counted towards a flood. The
+// window starts at a source's first probe, and a source is detected at most
+// once per window.
+type pingTracker struct {
+	detections *emitter
+	// a minimumHosts or maximumPackets of 0 disables that check.
+	minimumHosts   int
+	maximumPackets int
+	window         time.Duration
+	// packetClock tells time by the connections that are added rather than
+	// the wall clock, see Tracker.
+	packetClock bool
+	done        chan struct{}
+	// protects everything below.
+	l      sync.Mutex
+	m      map[string]*pingEntry
+	latest time.Time
+}
+
+// newPingTracker takes the window probes are counted within, and how many
+// hosts may be probed and probes sent within it and returns an instance of
+// pingTracker.
+func newPingTracker(window, evaluationInterval time.Duration, minimumHosts, maximumPackets int) (t *pingTracker) {
+	t = &pingTracker{
+		detections:     newEmitter(),
+		minimumHosts:   minimumHosts,
+		maximumPackets: maximumPackets,
+		window:         window,
+		done:           make(chan struct{}),
+		m:              make(map[string]*pingEntry),
+	}
+	go func() {
+		tick := time.NewTicker(evaluationInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-t.done:
+				return
+			}
+			t.l.Lock()
+			now := t.now()
+			for k, v := range t.m {
+				if now.Sub(v.scan.FirstSeen) > t.window {
+					log.V(2).Infof("removing ping entry %q because entry is expired", k)
+					delete(t.m, k)
+				}
+			}
+			t.l.Unlock()
+		}
+	}()
+	return
+}
+
+// now returns the wall clock, or the time of the most recent connection when
+// packetClock is set. The caller must hold t.l.
+func (t *pingTracker) now() time.Time {
+	if t.packetClock {
+		return t.latest
+	}
+	return time.Now()
+}
+
+// exceeded returns true when e has probed too many hosts or sent too many
+// probes.
+func (t *pingTracker) exceeded(e *pingEntry) bool {
+	return (t.minimumHosts > 0 && len(e.seen) > t.minimumHosts) ||
+		(t.maximumPackets > 0 && e.scan.Packets > t.maximumPackets)
+}
+
+// Add adds the connection v into the tracker, anything other than an ICMP
+// probe is ignored.
+func (t *pingTracker) Add(v *Connection) {
+	if v.Protocol != ProtocolICMP {
+		return
+	}
+	t.l.Lock()
+	if t.packetClock && v.Time.After(t.latest) {
+		t.latest = v.Time
+	}
+	now := t.now()
+	k := v.Src.IP.String()
+	e, ok := t.m[k]
+	// The entry may have expired without being removed yet.
+	if !ok || now.Sub(e.scan.FirstSeen) > t.window {
+		e = &pingEntry{
+			scan: PingScan{SrcIP: &v.Src.IP, FirstSeen: now},
+			seen: make(map[string]bool),
+		}
+		t.m[k] = e
+	}
+	if !v.Solicitation {
+		e.scan.Packets++
+	}
+	e.scan.LastSeen = now
+	if d := v.Dst.IP.String(); !e.reported && !e.seen[d] {
+		e.seen[d] = true
+		if len(e.scan.DstIPs) < maxPingDstIPs {
+			e.scan.DstIPs = append(e.scan.DstIPs, &v.Dst.IP)
+		}
+	}
+	if e.reported || !t.exceeded(e) {
+		t.l.Unlock()
+		return
+	}
+	log.V(2).Infof("%s probed %d hosts in %d packets within %v", k, len(e.seen), e.scan.Packets, t.window)
+	e.reported = true
+	scan := e.scan
+	scan.DstIPs = append([]*net.IP(nil), e.scan.DstIPs...)
+	t.l.Unlock()
+	t.detections.emit(&Detection{
+		Detector:  t.Name(),
+		SrcIPs:    []*net.IP{scan.SrcIP},
+		Evidence:  &scan,
+		Severity:  SeverityMedium,
+		FirstSeen: scan.FirstSeen,
+		LastSeen:  scan.LastSeen,
+	})
+}
+
+// Name returns the name of the pingTracker's detections.
+func (t *pingTracker) Name() string {
+	return "ping scan"
+}
+
+// Detections returns a channel that callers can retrieve ping sweeps and
+// floods from, the Evidence is a *PingScan.
+func (t *pingTracker) Detections() chan *Detection {
+	return t.detections.c
+}
+
+// Close stops expiring entries, and closes the Detections channel.
+func (t *pingTracker) Close() {
+	close(t.done)
+	t.detections.close()
+}
@@ -0,0 +1,103 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPingTracker(t *testing.T) {
+	srcIP := net.ParseIP("10.0.0.1")
+	// hosts is the network that echo requests go to.
+	const hosts = "192.168.86"
+	// echo returns an echo request to hosts.<n>.
+	echo := func(n int) *Connection {
+		c := conn(srcIP, host(hosts, n), 0)
+		c.Protocol = ProtocolICMP
+		return c
+	}
+	// solicit makes c a neighbour solicitation.
+	solicit := func(c *Connection) *Connection {
+		c.Solicitation = true
+		return c
+	}
+	testCases := []struct {
+		desc    string
+		hosts   int
+		packets int
+		in      []*Connection
+		want    []*PingScan
+	}{
+		{
+			desc:  "test echo requests to many hosts are a ping sweep",
+			hosts: 2,
+			in:    []*Connection{at(0, echo(1)), at(1, echo(2)), at(2, echo(2)), at(3, echo(3)), at(4, echo(4))},
+			want: []*PingScan{
+				{
+					SrcIP:     &srcIP,
+					DstIPs:    ips(hosts, 1, 2, 3),
+					Packets:   4,
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(3 * time.Second),
+				},
+			},
+		},
+		{
+			desc:    "test many echo requests to a host are a ping flood",
+			packets: 3,
+			in:      []*Connection{at(0, echo(1)), at(0, echo(1)), at(1, echo(1)), at(1, echo(1)), at(2, echo(1))},
+			want: []*PingScan{
+				{
+					SrcIP:     &srcIP,
+					DstIPs:    ips(hosts, 1),
+					Packets:   4,
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(time.Second),
+				},
+			},
+		},
+		{
+			desc:    "test neighbour solicitations aren't a ping flood",
+			packets: 3,
+			in:      []*Connection{solicit(at(0, echo(1))), solicit(at(0, echo(1))), solicit(at(1, echo(1))), solicit(at(1, echo(1))), at(2, echo(1))},
+		},
+		{
+			desc:  "test neighbour solicitations to many hosts are a ping sweep",
+			hosts: 2,
+			in:    []*Connection{solicit(at(0, echo(1))), solicit(at(1, echo(2))), solicit(at(2, echo(3)))},
+			want: []*PingScan{
+				{
+					SrcIP:     &srcIP,
+					DstIPs:    ips(hosts, 1, 2, 3),
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(2 * time.Second),
+				},
+			},
+		},
+		{
+			desc:  "test hosts spread wider than the window aren't a ping sweep",
+			hosts: 2,
+			in:    []*Connection{at(0, echo(1)), at(6, echo(2)), at(12, echo(3)), at(18, echo(4))},
+		},
+		{
+			desc:  "test connections with ports are ignored",
+			hosts: 1,
+			in:    []*Connection{conn(srcIP, host(hosts, 1), 22), conn(srcIP, host(hosts, 2), 22)},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tkr := newPingTracker(10*time.Second, time.Hour, tC.hosts, tC.packets)
+			tkr.packetClock = true
+			var got []*PingScan
+			for _, d := range collect(tkr, tC.in) {
+				got = append(got, d.Evidence.(*PingScan))
+			}
+			if diff := cmp.Diff(tC.want, got); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
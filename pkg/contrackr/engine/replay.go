@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"os"
+	"reflect"
+)
+
+// Replay feeds the packets captured in file through every enabled Detector,
+// and returns their Detections in the order they were raised. The built in
+// Detectors tell time by the packet timestamps rather than the wall clock, so
+// captures that span hours are evaluated as they would have been live. The
+// firewall is never touched, so only the options that configure detection
+// apply.
+func Replay(file *os.File, opts ...Option) ([]*Detection, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	cptr, err := newCapturerOffline(file, o.capture())
+	if err != nil {
+		return nil, err
+	}
+	defer cptr.Close()
+
+	detectors := o.newDetectors(true)
+	cases := make([]reflect.SelectCase, len(detectors))
+	for i, d := range detectors {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(d.Detections())}
+	}
+	var detected []*Detection
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Packets are added one at a time, so receiving from every Detector
+		// in one goroutine keeps the Detections in the order they were raised.
+		for open := len(cases); open > 0; {
+			i, v, ok := reflect.Select(cases)
+			if !ok {
+				// Never select the closed channel again.
+				cases[i].Chan = reflect.Value{}
+				open--
+				continue
+			}
+			detected = append(detected, v.Interface().(*Detection))
+		}
+	}()
+	for pkt := range cptr.Capture() {
+		for _, d := range detectors {
+			d.Add(pkt)
+		}
+	}
+	for _, d := range detectors {
+		d.Close()
+	}
+	<-done
+	return detected, nil
+}
@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestReplay(t *testing.T) {
+	fastIP, slowIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.200"), net.ParseIP("192.168.86.191")
+	fast := &TrackerEntry{
+		Kind:      KindPortScan,
+		DstIP:     &dstIP,
+		SrcIP:     &fastIP,
+		DstIPs:    []*net.IP{&dstIP},
+		SrcIPs:    []*net.IP{&fastIP},
+		Ports:     map[int]int{22: 1, 80: 1, 443: 1, 3306: 1},
+		FirstSeen: time.Unix(1624689612, 0),
+		LastSeen:  time.Unix(1624689615, 0),
+	}
+	testCases := []struct {
+		desc string
+		opts []Option
+		want []Evidence
+	}{
+		{
+			desc: "test only the fast scanner is detected",
+			want: []Evidence{fast},
+		},
+		{
+			// Each scanner is detected once within the window, even though
+			// they go on to scan another port.
+			desc: "test the slow scanner is detected with a lower threshold",
+			opts: []Option{WithMinimumPortScanned(2)},
+			want: []Evidence{
+				&TrackerEntry{
+					Kind:      KindPortScan,
+					DstIP:     &dstIP,
+					SrcIP:     &fastIP,
+					DstIPs:    []*net.IP{&dstIP},
+					SrcIPs:    []*net.IP{&fastIP},
+					Ports:     map[int]int{22: 1, 80: 1, 443: 1},
+					FirstSeen: time.Unix(1624689612, 0),
+					LastSeen:  time.Unix(1624689614, 0),
+				},
+				&TrackerEntry{
+					Kind:      KindPortScan,
+					DstIP:     &dstIP,
+					SrcIP:     &slowIP,
+					DstIPs:    []*net.IP{&dstIP},
+					SrcIPs:    []*net.IP{&slowIP},
+					Ports:     map[int]int{22: 1, 80: 1, 443: 1},
+					FirstSeen: time.Unix(1624689622, 0),
+					LastSeen:  time.Unix(1624689682, 0),
+				},
+			},
+		},
+		{
+			desc: "test the slow scanner is detected by the low and slow detector",
+			opts: []Option{WithSlowScan(3, time.Hour)},
+			want: []Evidence{
+				fast,
+				&SlowScan{
+					Prefix:    &net.IPNet{IP: fastIP.To4(), Mask: net.CIDRMask(32, 32)},
+					SrcIPs:    []*net.IP{&fastIP},
+					Ports:     4,
+					FirstSeen: time.Unix(1624689612, 0),
+					LastSeen:  time.Unix(1624689615, 0),
+				},
+				&SlowScan{
+					Prefix:    &net.IPNet{IP: slowIP.To4(), Mask: net.CIDRMask(32, 32)},
+					SrcIPs:    []*net.IP{&slowIP},
+					Ports:     4,
+					FirstSeen: time.Unix(1624689622, 0),
+					LastSeen:  time.Unix(1624689712, 0),
+				},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			// port_scan.pcap was generated rather than captured. 192.168.86.158
+			// sends SYNs to 4 ports a second apart, and 192.168.86.200 sends
+			// SYNs to 4 ports 30 seconds apart, so it never scans more than 3
+			// ports within a minute.
+			file, err := os.Open("testdata/port_scan.pcap")
+			if err != nil {
+				t.Fatalf("os.Open() = %v, want nil error", err)
+			}
+			detected, err := Replay(file, tC.opts...)
+			if err != nil {
+				t.Fatalf("Replay() = %v, want nil error", err)
+			}
+			var got []Evidence
+			for _, d := range detected {
+				got = append(got, d.Evidence)
+			}
+			if diff := cmp.Diff(tC.want, got, cmpopts.IgnoreUnexported(TrackerEntry{})); diff != "" {
+				t.Errorf("Replay() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReplayUnanswered(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	testCases := []struct {
+		desc string
+		opts []Option
+		want []Evidence
+	}{
+		{
+			desc: "test every SYN is counted by default",
+			want: []Evidence{
+				&TrackerEntry{
+					Kind:      KindPortScan,
+					DstIP:     &dstIP,
+					SrcIP:     &srcIP,
+					DstIPs:    []*net.IP{&dstIP},
+					SrcIPs:    []*net.IP{&srcIP},
+					Ports:     map[int]int{22: 1, 3306: 1, 6379: 1, 8080: 1},
+					FirstSeen: time.Unix(1624690800, 0),
+					LastSeen:  time.Unix(1624690803, 0),
+				},
+			},
+		},
+		{
+			desc: "test only SYNs that weren't answered with a SYN-ACK are counted",
+			opts: []Option{WithUnansweredSYNs()},
+			want: []Evidence{
+				&TrackerEntry{
+					Kind:      KindPortScan,
+					DstIP:     &dstIP,
+					SrcIP:     &srcIP,
+					DstIPs:    []*net.IP{&dstIP},
+					SrcIPs:    []*net.IP{&srcIP},
+					Ports:     map[int]int{3306: 1, 6379: 1, 8080: 1, 9200: 1},
+					FirstSeen: time.Unix(1624690800, 0),
+					LastSeen:  time.Unix(1624690806, 0),
+				},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			// unanswered.pcap was generated rather than captured, see
+			// TestParse.
+			file, err := os.Open("testdata/unanswered.pcap")
+			if err != nil {
+				t.Fatalf("os.Open() = %v, want nil error", err)
+			}
+			detected, err := Replay(file, tC.opts...)
+			if err != nil {
+				t.Fatalf("Replay() = %v, want nil error", err)
+			}
+			var got []Evidence
+			for _, d := range detected {
+				got = append(got, d.Evidence)
+			}
+			if diff := cmp.Diff(tC.want, got, cmpopts.IgnoreUnexported(TrackerEntry{})); diff != "" {
+				t.Errorf("Replay() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReplayUDPReplies(t *testing.T) {
+	// udp_replies.pcap was generated rather than captured, see TestParse.
+	file, err := os.Open("testdata/udp_replies.pcap")
+	if err != nil {
+		t.Fatalf("os.Open() = %v, want nil error", err)
+	}
+	// Replies to the host's DNS queries aren't a UDP port scan of it.
+	detected, err := Replay(file, WithUDP(), WithMinimumPortScanned(1))
+	if err != nil {
+		t.Fatalf("Replay() = %v, want nil error", err)
+	}
+	for _, d := range detected {
+		t.Errorf("Replay() detected %s: %s, want no detections", d.Detector, d.Evidence)
+	}
+}
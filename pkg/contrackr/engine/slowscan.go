@@ -0,0 +1,236 @@
+package engine
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// maxSlowScanSrcIPs caps how many source IPs are remembered for each source
+// prefix, so that large IPv6 prefixes stay bounded too.
+const maxSlowScanSrcIPs = 256
+
+// maxSlowScanEntries caps how many source prefixes are remembered at once, the
+// least recently seen prefix is forgotten to make room for a new one.
+const maxSlowScanEntries = 16384
+
+// SlowScan is a source prefix that connected to more distinct ports than the
+// low-and-slow threshold within the horizon.
+type SlowScan struct {
+	Prefix *net.IPNet
+	// SrcIPs are the distinct IPs seen from Prefix, in the order they were
+	// first seen.
+	SrcIPs []*net.IP
+	// Ports is the estimated number of distinct ports connected to.
+	Ports     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// String returns the prefix, sources and estimated ports of s.
+func (s *SlowScan) String() string {
+	return fmt.Sprintf("%s (%s) on ~%d ports", s.Prefix, ipList(s.SrcIPs), s.Ports)
+}
+
+// slowEntry counts the distinct ports a source prefix connected to, in two
+// generations that are each half of the horizon long.
+type slowEntry struct {
+	scan      SlowScan
+	cur, prev hyperLogLog
+	// rotated is when cur was started.
+	rotated  time.Time
+	reported bool
+	seen     map[string]bool
+	// elem is the entry's place in slowTracker.lru.
+	elem *list.Element
+}
+
+// rotate starts a new generation if cur is at least half a horizon old, so
+// that a port is remembered for between half a horizon and a whole one.
+func (e *slowEntry) rotate(now time.Time, horizon time.Duration) {
+	switch d := now.Sub(e.rotated); {
+	case d >= horizon:
+		e.cur, e.prev = hyperLogLog{}, hyperLogLog{}
+		e.rotated = now
+	case d >= horizon/2:
+		e.prev, e.cur = e.cur, hyperLogLog{}
+		e.rotated = e.rotated.Add(horizon / 2)
+	default:
+		return
+	}
+	// Report a source again if it's still scanning after a rotation.
+	e.reported = false
+}
+
+// count returns the estimated number of distinct ports within the horizon.
+func (e *slowEntry) count() int {
+	h := e.prev
+	h.merge(&e.cur)
+	return h.count()
+}
+
+// slowTracker is the Detector for low-and-slow port scanners, that connect to
+// too few ports within the Tracker's window to be noticed, by counting the
+// distinct ports each source prefix connects to over a much longer horizon.
+type slowTracker struct {
+	detections     *emitter
+	threshold      int
+	horizon        time.Duration
+	v4Mask, v6Mask net.IPMask
+	// packetClock tells time by the connections that are added rather than
+	// the wall clock, see Tracker.
+	packetClock bool
+	done        chan struct{}
+	// maxEntries caps the size of m.
+	maxEntries int
+	// protects everything below.
+	l sync.Mutex
+	m map[string]*slowEntry
+	// lru holds the keys of m, the most recently seen first.
+	lru    *list.List
+	latest time.Time
+}
+
+// newSlowTracker takes the horizon ports are counted over, how many distinct
+// ports a source prefix may connect to within it, and the prefix lengths
+// sources are grouped by and returns an instance of slowTracker.
+func newSlowTracker(horizon, evaluationInterval time.Duration, threshold, v4Bits, v6Bits int) (t *slowTracker) {
+	t = &slowTracker{
+		detections: newEmitter(),
+		threshold:  threshold,
+		horizon:    horizon,
+		v4Mask:     net.CIDRMask(v4Bits, 8*net.IPv4len),
+		v6Mask:     net.CIDRMask(v6Bits, 8*net.IPv6len),
+		done:       make(chan struct{}),
+		maxEntries: maxSlowScanEntries,
+		m:          make(map[string]*slowEntry),
+		lru:        list.New(),
+	}
+	go func() {
+		tick := time.NewTicker(evaluationInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-t.done:
+				return
+			}
+			t.l.Lock()
+			now := t.now()
+			for b := t.lru.Back(); b != nil; b = t.lru.Back() {
+				k := b.Value.(string)
+				if now.Sub(t.m[k].scan.LastSeen) <= t.horizon {
+					break
+				}
+				log.V(2).Infof("removing slow scan entry %q because entry is expired", k)
+				t.remove(k)
+			}
+			t.l.Unlock()
+		}
+	}()
+	return
+}
+
+// now returns the wall clock, or the time of the most recent connection when
+// packetClock is set. The caller must hold t.l.
+func (t *slowTracker) now() time.Time {
+	if t.packetClock {
+		return t.latest
+	}
+	return time.Now()
+}
+
+// remove forgets the entry for the source prefix k. The caller must hold t.l.
+func (t *slowTracker) remove(k string) {
+	t.lru.Remove(t.m[k].elem)
+	delete(t.m, k)
+}
+
+// prefix returns the source prefix of v.
+func (t *slowTracker) prefix(v *Connection) *net.IPNet {
+	if ip4 := v.Src.IP.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4.Mask(t.v4Mask), Mask: t.v4Mask}
+	}
+	return &net.IPNet{IP: v.Src.IP.Mask(t.v6Mask), Mask: t.v6Mask}
+}
+
+// Add adds the connection v into the tracker, ICMP probes and the host's
+// answers to SYNs are ignored.
+func (t *slowTracker) Add(v *Connection) {
+	if !v.Protocol.hasPorts() || v.Reply != ReplyNone {
+		return
+	}
+	t.l.Lock()
+	if t.packetClock && v.Time.After(t.latest) {
+		t.latest = v.Time
+	}
+	now := t.now()
+	prefix := t.prefix(v)
+	k := prefix.String()
+	e, ok := t.m[k]
+	if ok {
+		t.lru.MoveToFront(e.elem)
+	} else {
+		if len(t.m) >= t.maxEntries {
+			b := t.lru.Back().Value.(string)
+			log.V(2).Infof("removing slow scan entry %q to make room for %q", b, k)
+			t.remove(b)
+		}
+		e = &slowEntry{
+			scan:    SlowScan{Prefix: prefix, FirstSeen: now},
+			rotated: now,
+			seen:    make(map[string]bool),
+			elem:    t.lru.PushFront(k),
+		}
+		t.m[k] = e
+	}
+	e.rotate(now, t.horizon)
+	// UDP ports are distinct from the TCP ports with the same number.
+	e.cur.add(uint64(v.Protocol)<<16 | uint64(v.Dst.Port))
+	e.scan.LastSeen = now
+	if ip := v.Src.IP.String(); !e.seen[ip] && len(e.scan.SrcIPs) < maxSlowScanSrcIPs {
+		e.seen[ip] = true
+		e.scan.SrcIPs = append(e.scan.SrcIPs, &v.Src.IP)
+	}
+	n := e.count()
+	if e.reported || n <= t.threshold {
+		t.l.Unlock()
+		return
+	}
+	log.V(2).Infof("%s scanned ~%d > %d ports within %v", prefix, n, t.threshold, t.horizon)
+	e.reported = true
+	scan := e.scan
+	scan.Ports = n
+	scan.SrcIPs = append([]*net.IP(nil), e.scan.SrcIPs...)
+	t.l.Unlock()
+	t.detections.emit(&Detection{
+		Detector:  t.Name(),
+		SrcIPs:    scan.SrcIPs,
+		Evidence:  &scan,
+		Severity:  SeverityMedium,
+		FirstSeen: scan.FirstSeen,
+		LastSeen:  scan.LastSeen,
+	})
+}
+
+// Name returns the name of the slowTracker's detections.
+func (t *slowTracker) Name() string {
+	return "low and slow scan"
+}
+
+// Detections returns a channel that callers can retrieve low-and-slow port
+// scans from, the Evidence is a *SlowScan. Each source prefix is sent at most
+// once per half horizon.
+func (t *slowTracker) Detections() chan *Detection {
+	return t.detections.c
+}
+
+// Close stops expiring entries, and closes the Detections channel.
+func (t *slowTracker) Close() {
+	close(t.done)
+	t.detections.close()
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSlowTracker(t *testing.T) {
+	srcIP, neighbourSrcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.159"), net.ParseIP("192.168.86.191")
+	otherSrcIP := net.ParseIP("10.0.0.1")
+	// atMinutes returns a Connection from src to port, made the given
+	// minutes after epoch.
+	atMinutes := func(minutes int, src net.IP, port int) *Connection {
+		c := conn(src, dstIP, port)
+		c.Time = epoch.Add(time.Duration(minutes) * time.Minute)
+		return c
+	}
+	testCases := []struct {
+		desc           string
+		v4Bits, v6Bits int
+		// maxEntries overrides maxSlowScanEntries when set.
+		maxEntries int
+		in         []*Connection
+		want       []string
+	}{
+		{
+			desc:   "test a port every 30 minutes is detected",
+			v4Bits: 32, v6Bits: 128,
+			in:   []*Connection{atMinutes(0, srcIP, 22), atMinutes(30, srcIP, 80), atMinutes(60, srcIP, 443), atMinutes(90, srcIP, 3306)},
+			want: []string{"192.168.86.158/32 [192.168.86.158]"},
+		},
+		{
+			desc:   "test repeated ports aren't detected",
+			v4Bits: 32, v6Bits: 128,
+			in: []*Connection{atMinutes(0, srcIP, 22), atMinutes(30, srcIP, 22), atMinutes(60, srcIP, 80), atMinutes(90, srcIP, 80), atMinutes(120, srcIP, 443)},
+		},
+		{
+			desc:   "test ports are forgotten after the horizon",
+			v4Bits: 32, v6Bits: 128,
+			in: []*Connection{atMinutes(0, srcIP, 22), atMinutes(90, srcIP, 80), atMinutes(180, srcIP, 443), atMinutes(270, srcIP, 3306)},
+		},
+		{
+			desc:   "test ports are counted per prefix",
+			v4Bits: 24, v6Bits: 64,
+			in:   []*Connection{atMinutes(0, srcIP, 22), atMinutes(30, neighbourSrcIP, 80), atMinutes(60, srcIP, 443), atMinutes(90, neighbourSrcIP, 3306)},
+			want: []string{"192.168.86.0/24 [192.168.86.158 192.168.86.159]"},
+		},
+		{
+			desc:   "test a scanner is reported once per generation",
+			v4Bits: 32, v6Bits: 128,
+			in: []*Connection{
+				atMinutes(0, srcIP, 22), atMinutes(30, srcIP, 80), atMinutes(60, srcIP, 443), atMinutes(90, srcIP, 3306),
+				atMinutes(100, srcIP, 8080), atMinutes(110, srcIP, 8443),
+				// The first generation is dropped, leaving 443 onwards.
+				atMinutes(130, srcIP, 5432),
+			},
+			want: []string{"192.168.86.158/32 [192.168.86.158]", "192.168.86.158/32 [192.168.86.158]"},
+		},
+		{
+			desc:   "test the least recently seen source is forgotten when full",
+			v4Bits: 32, v6Bits: 128, maxEntries: 2,
+			in: []*Connection{
+				atMinutes(0, srcIP, 22), atMinutes(5, neighbourSrcIP, 22), atMinutes(10, srcIP, 80),
+				// neighbourSrcIP is forgotten, rather than srcIP.
+				atMinutes(15, otherSrcIP, 22),
+				atMinutes(20, srcIP, 443), atMinutes(25, neighbourSrcIP, 80), atMinutes(30, neighbourSrcIP, 443),
+				atMinutes(35, srcIP, 3306), atMinutes(40, neighbourSrcIP, 3306),
+			},
+			want: []string{"192.168.86.158/32 [192.168.86.158]"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tkr := newSlowTracker(2*time.Hour, time.Hour, 3, tC.v4Bits, tC.v6Bits)
+			tkr.packetClock = true
+			if tC.maxEntries > 0 {
+				tkr.maxEntries = tC.maxEntries
+			}
+			var got []string
+			for _, d := range collect(tkr, tC.in) {
+				v := d.Evidence.(*SlowScan)
+				got = append(got, v.Prefix.String()+" "+fmtIPs(v.SrcIPs))
+			}
+			if diff := cmp.Diff(tC.want, got); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// fmtIPs formats ips like a slice of strings.
+func fmtIPs(ips []*net.IP) string {
+	s := make([]string, len(ips))
+	for i, v := range ips {
+		s[i] = v.String()
+	}
+	return fmt.Sprint(s)
+}
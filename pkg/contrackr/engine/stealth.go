@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// bpfStealthFilter is the BPF filter that is used to capture stealth probes,
+// TCP packets with none of the SYN, ACK or RST flags set. Every legitimate
+// TCP packet has at least one of them, so these are only sent by scanners
+// (eg. nmap -sF, -sN and -sX) hoping to slip past SYN-only monitors. Like
+// bpfFilter, IPv6 has to be matched by inspecting the flags 13 bytes into the
+// TCP header.
+const bpfStealthFilter = `tcp[tcpflags] & (tcp-syn|tcp-ack|tcp-rst) = 0
+or (ip6[6] = 6 and ip6[13+40]&0x16 = 0)`
+
+// StealthProbe is the kind of stealth probe a Connection was captured from.
+type StealthProbe string
+
+const (
+	// ProbeNone is any connection that isn't a stealth probe, such as a SYN.
+	ProbeNone StealthProbe = ""
+	// ProbeFIN only has the FIN flag set (nmap -sF).
+	ProbeFIN StealthProbe = "FIN"
+	// ProbeNULL has no flags set (nmap -sN).
+	ProbeNULL StealthProbe = "NULL"
+	// ProbeXMAS has the FIN, PSH and URG flags set (nmap -sX).
+	ProbeXMAS StealthProbe = "XMAS"
+	// ProbeOther is any other combination without SYN, ACK or RST.
+	ProbeOther StealthProbe = "unusual flags"
+)
+
+// stealthProbe returns the kind of stealth probe tcp is, or ProbeNone when it
+// has the SYN, ACK or RST flag set.
+func stealthProbe(tcp *layers.TCP) StealthProbe {
+	if tcp.SYN || tcp.ACK || tcp.RST {
+		return ProbeNone
+	}
+	switch {
+	case tcp.FIN && tcp.PSH && tcp.URG:
+		return ProbeXMAS
+	case tcp.FIN && !tcp.PSH && !tcp.URG:
+		return ProbeFIN
+	case !tcp.FIN && !tcp.PSH && !tcp.URG:
+		return ProbeNULL
+	}
+	return ProbeOther
+}
+
+// newStealthTracker returns a Tracker for stealth scans, that only counts the
+// ports stealth probes are sent to. A minimumPortScanned of 0 detects a source
+// on its first probe.
+func newStealthTracker(maxAge, evaluationInterval time.Duration, minimumPortScanned int) *Tracker {
+	t := newTracker(maxAge, evaluationInterval, minimumPortScanned)
+	t.kind = KindStealth
+	return t
+}
@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/gopacket/layers"
+)
+
+func TestStealthProbe(t *testing.T) {
+	testCases := []struct {
+		desc string
+		tcp  layers.TCP
+		want StealthProbe
+	}{
+		{desc: "SYN", tcp: layers.TCP{SYN: true}, want: ProbeNone},
+		{desc: "FIN + ACK", tcp: layers.TCP{FIN: true, ACK: true}, want: ProbeNone},
+		{desc: "RST", tcp: layers.TCP{RST: true}, want: ProbeNone},
+		{desc: "FIN", tcp: layers.TCP{FIN: true}, want: ProbeFIN},
+		{desc: "NULL", tcp: layers.TCP{}, want: ProbeNULL},
+		{desc: "XMAS", tcp: layers.TCP{FIN: true, PSH: true, URG: true}, want: ProbeXMAS},
+		{desc: "PSH", tcp: layers.TCP{PSH: true}, want: ProbeOther},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if got := stealthProbe(&tC.tcp); got != tC.want {
+				t.Errorf("stealthProbe() = %q, want %q", got, tC.want)
+			}
+		})
+	}
+}
+
+func TestStealthTracker(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	// to returns a Connection to port, that is a stealth probe unless probe
+	// is ProbeNone.
+	to := func(port int, probe StealthProbe) *Connection {
+		c := conn(srcIP, dstIP, port)
+		c.Stealth = probe
+		return c
+	}
+	testCases := []struct {
+		desc               string
+		minimumPortScanned int
+		in                 []*Connection
+		want               []*TrackerEntry
+	}{
+		{
+			desc:               "test stealth probes to many ports are a stealth scan",
+			minimumPortScanned: 2,
+			in:                 []*Connection{at(0, to(21, ProbeFIN)), at(1, to(22, ProbeNULL)), at(2, to(23, ProbeXMAS))},
+			want: []*TrackerEntry{
+				{
+					Kind:      KindStealth,
+					DstIP:     &dstIP,
+					SrcIP:     &srcIP,
+					DstIPs:    []*net.IP{&dstIP},
+					SrcIPs:    []*net.IP{&srcIP},
+					Ports:     map[int]int{21: 1, 22: 1, 23: 1},
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(2 * time.Second),
+				},
+			},
+		},
+		{
+			desc:               "test SYNs are left to the port scan Tracker",
+			minimumPortScanned: 2,
+			in:                 []*Connection{at(0, to(21, ProbeNone)), at(1, to(22, ProbeNone)), at(2, to(23, ProbeFIN))},
+		},
+		{
+			desc: "test the first stealth probe is a stealth scan",
+			in:   []*Connection{at(0, to(21, ProbeNone)), at(1, to(22, ProbeXMAS))},
+			want: []*TrackerEntry{
+				{
+					Kind:      KindStealth,
+					DstIP:     &dstIP,
+					SrcIP:     &srcIP,
+					DstIPs:    []*net.IP{&dstIP},
+					SrcIPs:    []*net.IP{&srcIP},
+					Ports:     map[int]int{22: 1},
+					FirstSeen: epoch.Add(time.Second),
+					LastSeen:  epoch.Add(time.Second),
+				},
+			},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tkr := newStealthTracker(time.Minute, time.Hour, tC.minimumPortScanned)
+			tkr.packetClock = true
+			var got []*TrackerEntry
+			for _, d := range collect(tkr, tC.in) {
+				got = append(got, d.Evidence.(*TrackerEntry))
+			}
+			if diff := cmp.Diff(tC.want, got, cmpopts.IgnoreUnexported(TrackerEntry{})); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStealthFirstProbeIgnoresWeights(t *testing.T) {
+	o, err := newOptions([]Option{WithStealthScanFirstProbe(), WithPortWeights(ProtocolTCP, map[int]int{22: 0})})
+	if err != nil {
+		t.Fatalf("newOptions() = %v, want nil error", err)
+	}
+	tkr := o.stealthTracker()
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	c := conn(srcIP, dstIP, 22)
+	c.Stealth = ProbeFIN
+	var got []map[int]int
+	for _, d := range collect(tkr, []*Connection{c}) {
+		got = append(got, d.Evidence.(*TrackerEntry).Ports)
+	}
+	if diff := cmp.Diff([]map[int]int{{22: 1}}, got); diff != "" {
+		t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// sweepEntry is a source connecting to one port on many hosts.
+type sweepEntry struct {
+	e *TrackerEntry
+	// hosts is when each of e.DstIPs was last connected to.
+	hosts map[string]time.Time
+}
+
+// slide forgets the hosts last connected to, and the connections made, before
+// start.
+func (s *sweepEntry) slide(start time.Time) {
+	s.e.slide(start)
+	dstIPs := s.e.DstIPs[:0]
+	for _, ip := range s.e.DstIPs {
+		if s.hosts[ip.String()].Before(start) {
+			delete(s.hosts, ip.String())
+			continue
+		}
+		dstIPs = append(dstIPs, ip)
+	}
+	s.e.DstIPs = dstIPs
+}
+
+// sweepTracker is the Detector for horizontal sweeps, where a source connects
+// to the same port on more than minimumHostsScanned hosts within a sliding
+// window of maxAge. They're only seen when contrackr is capturing traffic to
+// more than one host, such as on a router or in promiscuous mode.
+type sweepTracker struct {
+	detections          *emitter
+	minimumHostsScanned int
+	maxAge              time.Duration
+	// os guesses the operating system of each entry, it may be nil.
+	os *OSDatabase
+	// packetClock tells time by the connections that are added rather than
+	// the wall clock, see Tracker.
+	packetClock bool
+	done        chan struct{}
+	// protects everything below.
+	l      sync.Mutex
+	m      map[string]*sweepEntry
+	latest time.Time
+}
+
+// newSweepTracker takes the window that hosts are counted within, and the
+// minimum hosts scanned before a source is considered to be sweeping and
+// returns an instance of sweepTracker.
+func newSweepTracker(maxAge, evaluationInterval time.Duration, minimumHostsScanned int) (t *sweepTracker) {
+	t = &sweepTracker{
+		detections:          newEmitter(),
+		minimumHostsScanned: minimumHostsScanned,
+		maxAge:              maxAge,
+		done:                make(chan struct{}),
+		m:                   make(map[string]*sweepEntry),
+	}
+	go func() {
+		tick := time.NewTicker(evaluationInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-t.done:
+				return
+			}
+			t.l.Lock()
+			now := t.now()
+			for k, v := range t.m {
+				if now.After(v.e.expiry) {
+					log.V(2).Infof("removing sweep entry %q because entry is expired", k)
+					delete(t.m, k)
+					continue
+				}
+				v.slide(now.Add(-t.maxAge))
+			}
+			t.l.Unlock()
+		}
+	}()
+	return
+}
+
+// now returns the wall clock, or the time of the most recent connection when
+// packetClock is set. The caller must hold t.l.
+func (t *sweepTracker) now() time.Time {
+	if t.packetClock {
+		return t.latest
+	}
+	return time.Now()
+}
+
+// Add adds the connection v into the tracker, connections are tracked in a
+// Src IP + Dst Port tuple, separately for each Protocol. Like the Tracker, a
+// sweep is detected at most once per window.
+func (t *sweepTracker) Add(v *Connection) {
+	if !v.Protocol.hasPorts() || v.Reply != ReplyNone {
+		return
+	}
+	t.l.Lock()
+	key := protocolKey(v, fmt.Sprintf("[%s]>:%d", v.Src.IP, v.Dst.Port))
+	if t.packetClock && v.Time.After(t.latest) {
+		t.latest = v.Time
+	}
+	now := t.now()
+	s, ok := t.m[key]
+	// The entry may have expired without being removed yet.
+	if !ok || now.After(s.e.expiry) {
+		s = &sweepEntry{
+			e: &TrackerEntry{
+				Kind:      KindSweep,
+				Protocol:  v.Protocol,
+				DstIP:     &v.Dst.IP,
+				SrcIP:     &v.Src.IP,
+				SrcIPs:    []*net.IP{&v.Src.IP},
+				Ports:     make(map[int]int),
+				FirstSeen: now,
+				lastHit:   make(map[int]time.Time),
+			},
+			hosts: make(map[string]time.Time),
+		}
+		t.m[key] = s
+	}
+	s.slide(now.Add(-t.maxAge))
+	s.e.LastSeen = now
+	s.e.expiry = now.Add(t.maxAge)
+	if _, ok := s.hosts[v.Dst.IP.String()]; !ok {
+		s.e.DstIPs = append(s.e.DstIPs, &v.Dst.IP)
+	}
+	s.hosts[v.Dst.IP.String()] = now
+	s.e.Ports[v.Dst.Port]++
+	s.e.lastHit[v.Dst.Port] = now
+	if s.e.Tool == "" {
+		s.e.Tool, _ = fingerprintTool(v)
+	}
+	if s.e.OS == nil {
+		s.e.OS = t.os.Match(v)
+	}
+	if len(s.e.DstIPs) <= t.minimumHostsScanned || !s.e.due(now, t.maxAge) {
+		t.l.Unlock()
+		return
+	}
+	log.V(2).Infof("%s swept > %d hosts", key, t.minimumHostsScanned)
+	s.e.reported = now
+	c := s.e.copy()
+	t.l.Unlock()
+	t.detections.emit(&Detection{
+		Detector:  t.Name(),
+		SrcIPs:    c.SrcIPs,
+		Evidence:  c,
+		Severity:  SeverityHigh,
+		FirstSeen: c.FirstSeen,
+		LastSeen:  c.LastSeen,
+	})
+}
+
+// Name returns the name of the sweepTracker's detections.
+func (t *sweepTracker) Name() string {
+	return string(KindSweep)
+}
+
+// Detections returns a channel that callers can retrieve sources that connect
+// to the same port on multiple hosts from, the Evidence is a *TrackerEntry.
+func (t *sweepTracker) Detections() chan *Detection {
+	return t.detections.c
+}
+
+// Close stops expiring entries, and closes the Detections channel.
+func (t *sweepTracker) Close() {
+	close(t.done)
+	t.detections.close()
+}
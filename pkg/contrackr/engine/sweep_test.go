@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestSweepTracker(t *testing.T) {
+	srcIP := net.ParseIP("10.0.0.1")
+	// hosts is the network that connections go to.
+	const hosts = "192.168.86"
+	// to returns a Connection to port on hosts.<n>.
+	to := func(n, port int) *Connection {
+		return conn(srcIP, host(hosts, n), port)
+	}
+	testCases := []struct {
+		desc string
+		in   []*Connection
+		want []*TrackerEntry
+	}{
+		{
+			desc: "test one port on many hosts is a sweep",
+			in:   []*Connection{at(0, to(1, 22)), at(1, to(2, 22)), at(2, to(2, 22)), at(3, to(3, 22)), at(4, to(4, 22))},
+			want: []*TrackerEntry{
+				{
+					Kind:      KindSweep,
+					DstIP:     ips(hosts, 1)[0],
+					SrcIP:     &srcIP,
+					DstIPs:    ips(hosts, 1, 2, 3, 4),
+					SrcIPs:    []*net.IP{&srcIP},
+					Ports:     map[int]int{22: 5},
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(4 * time.Second),
+				},
+			},
+		},
+		{
+			desc: "test different ports on many hosts aren't a sweep",
+			in:   []*Connection{at(0, to(1, 22)), at(1, to(2, 23)), at(2, to(3, 80)), at(3, to(4, 443))},
+		},
+		{
+			desc: "test connections to hosts outside the window aren't counted",
+			in:   []*Connection{at(0, to(1, 22)), at(30, to(2, 22)), at(61, to(3, 22)), at(62, to(4, 22)), at(63, to(5, 22))},
+			want: []*TrackerEntry{
+				{
+					Kind:      KindSweep,
+					DstIP:     ips(hosts, 1)[0],
+					SrcIP:     &srcIP,
+					DstIPs:    ips(hosts, 2, 3, 4, 5),
+					SrcIPs:    []*net.IP{&srcIP},
+					Ports:     map[int]int{22: 5},
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(63 * time.Second),
+				},
+			},
+		},
+		{
+			desc: "test hosts spread wider than the window aren't a sweep",
+			in:   []*Connection{at(0, to(1, 22)), at(30, to(2, 22)), at(60, to(3, 22)), at(90, to(4, 22)), at(120, to(5, 22))},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tkr := newSweepTracker(time.Minute, time.Hour, 3)
+			tkr.packetClock = true
+			var got []*TrackerEntry
+			for _, d := range collect(tkr, tC.in) {
+				got = append(got, d.Evidence.(*TrackerEntry))
+			}
+			if diff := cmp.Diff(tC.want, got, cmpopts.IgnoreUnexported(TrackerEntry{})); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -3,88 +3,507 @@ package engine
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/golang/glog"
 )
 
+// ScanKind is the kind of scan a TrackerEntry was detected as.
+type ScanKind string
+
+const (
+	// KindPortScan is a source connecting to many ports on a host.
+	KindPortScan ScanKind = "port scan"
+	// KindSweep is a source connecting to the same port on many hosts.
+	KindSweep ScanKind = "sweep"
+	// KindStealth is a source sending stealth probes, such as FIN, NULL or
+	// XMAS packets, to many ports on a host.
+	KindStealth ScanKind = "stealth scan"
+)
+
 // TrackerEntry contains the Src and Dst IPs, as well as a map of Dst Ports
 // and how many times that port was scanned.
 type TrackerEntry struct {
-	DstIP  *net.IP
-	SrcIP  *net.IP
-	Ports  map[int]int
+	Kind ScanKind
+	// Protocol is the protocol of the ports, they're counted separately for
+	// each protocol.
+	Protocol Protocol
+	// DstIP and SrcIP are from the first connection in this entry.
+	DstIP *net.IP
+	SrcIP *net.IP
+	// DstIPs and SrcIPs are every distinct IP seen in this entry, in the order
+	// they were first seen. Depending on the Aggregation there may be more
+	// than one of each.
+	DstIPs []*net.IP
+	SrcIPs []*net.IP
+	// Ports only counts the connections within the tracker's window.
+	Ports map[int]int
+	// Tool is the scanning tool that likely sent the connections, or "" if
+	// none of them look like one.
+	Tool string
+	// OS is the operating system that likely sent the connections, or nil if
+	// none of them match a signature.
+	OS *OSGuess
+	// FirstSeen and LastSeen are the times of the first and the most recent
+	// connection in this entry.
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// expiry is when the entry is removed, it's pushed out on every
+	// connection.
 	expiry time.Time
+	// reported is when the entry was last detected, it's detected at most
+	// once per window.
+	reported time.Time
+	// seen is the set of IPs in DstIPs and SrcIPs.
+	seen map[string]bool
+	// lastHit is when each port in Ports was last connected to. A port's
+	// count only resets once it has had no connections for a whole window,
+	// so that a source flooding one port doesn't grow the entry.
+	lastHit map[int]time.Time
+	// pending are the SYNs waiting on the host's answer, by their 4-tuple,
+	// when only unanswered SYNs are counted.
+	pending map[string]held
+	// early are the host's answers that were read before their SYN, by its
+	// 4-tuple. Answers are captured separately from SYNs, so either may be
+	// read first.
+	early map[string]held
+}
+
+// held is a SYN waiting on the host's answer, or an answer waiting on its
+// SYN, and when it was added.
+type held struct {
+	v     *Connection
+	added time.Time
+}
+
+// copy returns a copy of e that is safe to read once the tracker lock is
+// released.
+func (e *TrackerEntry) copy() *TrackerEntry {
+	c := *e
+	c.Ports = make(map[int]int, len(e.Ports))
+	for k, v := range e.Ports {
+		c.Ports[k] = v
+	}
+	c.DstIPs = append([]*net.IP(nil), e.DstIPs...)
+	c.SrcIPs = append([]*net.IP(nil), e.SrcIPs...)
+	c.seen = nil
+	c.lastHit = nil
+	c.pending = nil
+	c.early = nil
+	return &c
+}
+
+// String returns the sources, destinations and ports of e, and the likely
+// tool and operating system.
+func (e *TrackerEntry) String() string {
+	ports := make([]int, 0, len(e.Ports))
+	for k := range e.Ports {
+		ports = append(ports, k)
+	}
+	sort.Ints(ports)
+	var likely []string
+	if e.Tool != "" {
+		likely = append(likely, "likely "+e.Tool)
+	}
+	if e.OS != nil {
+		likely = append(likely, e.OS.String())
+	}
+	var suffix string
+	if len(likely) > 0 {
+		suffix = fmt.Sprintf(" (%s)", strings.Join(likely, "; "))
+	}
+	if e.Protocol != ProtocolTCP {
+		return fmt.Sprintf("%s -> %s on %s ports %v%s", ipList(e.SrcIPs), ipList(e.DstIPs), e.Protocol, ports, suffix)
+	}
+	return fmt.Sprintf("%s -> %s on ports %v%s", ipList(e.SrcIPs), ipList(e.DstIPs), ports, suffix)
+}
+
+// due returns true when e hasn't been reported within window of now.
+func (e *TrackerEntry) due(now time.Time, window time.Duration) bool {
+	return e.reported.IsZero() || now.Sub(e.reported) >= window
+}
+
+// add records connection v, made at now, in the entry. The port unreachable
+// reply to a datagram that was already seen isn't counted again.
+func (e *TrackerEntry) add(v *Connection, now time.Time) {
+	if e.Tool == "" {
+		e.Tool, _ = fingerprintTool(v)
+	}
+	if k := "dst " + v.Dst.IP.String(); !e.seen[k] {
+		e.seen[k] = true
+		e.DstIPs = append(e.DstIPs, &v.Dst.IP)
+	}
+	if k := "src " + v.Src.IP.String(); !e.seen[k] {
+		e.seen[k] = true
+		e.SrcIPs = append(e.SrcIPs, &v.Src.IP)
+	}
+	if v.Unreachable && e.Ports[v.Dst.Port] > 0 {
+		return
+	}
+	e.Ports[v.Dst.Port]++
+	e.lastHit[v.Dst.Port] = now
+}
+
+// syn records the SYN v, made at now, as pending unless the host's answer to
+// it was read first. An answer only matches a SYN with the same 4-tuple that
+// was sent no earlier than answerTimeout before it.
+func (e *TrackerEntry) syn(v *Connection, now time.Time) {
+	k := flowKey(v.Src, v.Dst)
+	a, ok := e.early[k]
+	if !ok || a.v.Time.Before(v.Time) || a.v.Time.Sub(v.Time) > answerTimeout {
+		e.pending[k] = held{v: v, added: now}
+		return
+	}
+	delete(e.early, k)
+	e.answered(v, a.v, now)
 }
 
-// Tracker contains the methods for tracking new connections, and retrieving
-// entries that constitute port scanning.
+// answer records the host's answer v, made at now, to the pending SYN with
+// the same 4-tuple. An answer without one is held until its SYN is added,
+// so a RST that isn't answering a SYN (eg. one tearing down an established
+// connection) never counts.
+func (e *TrackerEntry) answer(v *Connection, now time.Time) {
+	k := flowKey(v.Src, v.Dst)
+	p, ok := e.pending[k]
+	if !ok {
+		e.early[k] = held{v: v, added: now}
+		return
+	}
+	delete(e.pending, k)
+	e.answered(p.v, v, now)
+}
+
+// answered records that the SYN syn was answered with answer, at now. A RST
+// means the connection attempt failed, so the SYN is counted, while a SYN-ACK
+// means it succeeded and the SYN is forgotten.
+func (e *TrackerEntry) answered(syn, answer *Connection, now time.Time) {
+	if answer.Reply == ReplyRST {
+		e.add(syn, now)
+	}
+}
+
+// settle counts the pending SYNs that were added before deadline, at now, as
+// their connection attempts failed without an answer. Answers that were added
+// before deadline are forgotten, their SYN is never coming.
+func (e *TrackerEntry) settle(deadline, now time.Time) {
+	for k, a := range e.early {
+		if a.added.Before(deadline) {
+			delete(e.early, k)
+		}
+	}
+	var failed []held
+	for k, p := range e.pending {
+		if p.added.Before(deadline) {
+			failed = append(failed, p)
+			delete(e.pending, k)
+		}
+	}
+	// Count them in the order they were sent, so that DstIPs and SrcIPs are
+	// too.
+	sort.Slice(failed, func(i, j int) bool { return failed[i].added.Before(failed[j].added) })
+	for _, p := range failed {
+		e.add(p.v, now)
+	}
+}
+
+// slide forgets the ports last connected to before start.
+func (e *TrackerEntry) slide(start time.Time) {
+	for port, last := range e.lastHit {
+		if last.Before(start) {
+			delete(e.lastHit, port)
+			delete(e.Ports, port)
+		}
+	}
+}
+
+// Aggregation is how connections are grouped together into a TrackerEntry.
+type Aggregation string
+
+const (
+	// AggregateSrcDst tracks connections per Src IP + Dst IP, so ports are
+	// counted separately for each local IP address that was scanned.
+	AggregateSrcDst Aggregation = "src-dst"
+	// AggregateSrc tracks connections per Src IP, so ports scanned across
+	// every local IP address are counted together.
+	AggregateSrc Aggregation = "src"
+	// AggregatePrefix tracks connections per Src IP prefix (eg. a /24 or a
+	// /64), so ports scanned from neighbouring IPs are counted together.
+	AggregatePrefix Aggregation = "prefix"
+)
+
+// keyFunc returns the key that connection v is tracked under.
+type keyFunc func(v *Connection) string
+
+// protocolKey returns key prefixed with the protocol of v, other than for TCP,
+// so that each protocol is tracked separately.
+func protocolKey(v *Connection, key string) string {
+	if v.Protocol != ProtocolTCP {
+		return fmt.Sprintf("%s %s", v.Protocol, key)
+	}
+	return key
+}
+
+func srcDstKey(v *Connection) string {
+	return fmt.Sprintf("[%s]>[%s]", v.Src.IP, v.Dst.IP)
+}
+
+func srcKey(v *Connection) string {
+	return fmt.Sprintf("[%s]", v.Src.IP)
+}
+
+// srcPrefixKey returns a keyFunc that masks the Src IP to v4Bits for IPv4
+// and v6Bits for IPv6.
+func srcPrefixKey(v4Bits, v6Bits int) keyFunc {
+	v4Mask, v6Mask := net.CIDRMask(v4Bits, 8*net.IPv4len), net.CIDRMask(v6Bits, 8*net.IPv6len)
+	return func(v *Connection) string {
+		if ip4 := v.Src.IP.To4(); ip4 != nil {
+			return fmt.Sprintf("[%s/%d]", ip4.Mask(v4Mask), v4Bits)
+		}
+		return fmt.Sprintf("[%s/%d]", v.Src.IP.Mask(v6Mask), v6Bits)
+	}
+}
+
+// Tracker is the Detector for port scans, where the distinct ports a source
+// connects to within a sliding window of maxAge score more than
+// minimumPortScanned.
 type Tracker struct {
-	portScanners       chan *TrackerEntry
+	detections *emitter
+	// kind is KindPortScan, or KindStealth when only stealth probes are
+	// tracked. A port scan Tracker ignores stealth probes.
+	kind               ScanKind
 	minimumPortScanned int
-	maxAge             time.Duration
+	// weights are what each port of each protocol scores, ports that aren't
+	// in it score 1.
+	weights map[Protocol]map[int]int
+	// listening are the ports the host is listening on, which score
+	// listeningWeight unless they're in weights. It may be nil.
+	listening       *listeningPorts
+	listeningWeight int
+	// unanswered only counts the TCP SYNs that the host answers with a RST,
+	// or doesn't answer within answerTimeout, as connecting to an open port
+	// isn't probing. It's only set for KindPortScan.
+	unanswered bool
+	// maxAge is the window ports are counted within, entries are removed
+	// once they have had no connections for this long.
+	maxAge time.Duration
+	// key is the key connections are tracked under, see Aggregation.
+	key keyFunc
+	// os guesses the operating system of each entry, it may be nil.
+	os *OSDatabase
+	// packetClock tells time by the connections that are added rather than
+	// the wall clock, so that packet captures can be replayed.
+	packetClock bool
+	done        chan struct{}
 	// protects everything below.
 	l sync.Mutex
 	m map[string]*TrackerEntry
+	// latest is the time of the most recent connection, when packetClock is
+	// set.
+	latest time.Time
 }
 
-// newTracker takes the maximum age each entry should be tracked for, and
+// newTracker takes the window that ports are counted within, and
 // the minimum ports scanned before a src IP is considered a "port scanner"
 // and returns an instance of Tracker.
 func newTracker(maxAge, evaluationInterval time.Duration, minimumPortScanned int) (t *Tracker) {
 	t = &Tracker{
-		portScanners:       make(chan *TrackerEntry),
+		detections:         newEmitter(),
+		kind:               KindPortScan,
 		minimumPortScanned: minimumPortScanned,
 		maxAge:             maxAge,
+		key:                srcDstKey,
+		done:               make(chan struct{}),
 		m:                  make(map[string]*TrackerEntry),
 	}
 	go func() {
-		for now := range time.Tick(evaluationInterval) {
+		tick := time.NewTicker(evaluationInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-t.done:
+				return
+			}
 			t.l.Lock()
+			now := t.now()
+			var detected []*TrackerEntry
 			for k, v := range t.m {
 				if now.After(v.expiry) {
 					log.Infof("removing %q because entry is expired", k)
 					delete(t.m, k)
+					continue
+				}
+				v.slide(now.Add(-t.maxAge))
+				// SYNs that went unanswered may complete a port scan.
+				if t.unanswered {
+					v.settle(now.Add(-answerTimeout), now)
+					if c := t.detect(k, v, now); c != nil {
+						detected = append(detected, c)
+					}
 				}
 			}
 			t.l.Unlock()
+			for _, c := range detected {
+				t.emit(c)
+			}
 		}
 	}()
 	return
 }
 
-// Add adds the connection v into the tracker. Connections are tracked in a
-// Src IP + Dst IP tuple.
+// now returns the wall clock, or the time of the most recent connection when
+// packetClock is set. The caller must hold t.l.
+func (t *Tracker) now() time.Time {
+	if t.packetClock {
+		return t.latest
+	}
+	return time.Now()
+}
+
+// score returns the sum of the weights of the distinct ports in e. The
+// listening ports are read as they are now, a port only scores
+// listeningWeight when the host is listening on it on every one of e.DstIPs.
+func (t *Tracker) score(e *TrackerEntry) int {
+	var n int
+	for p := range e.Ports {
+		w, ok := t.weights[e.Protocol][p]
+		if !ok && t.listeningOnAll(e, p) {
+			w, ok = t.listeningWeight, true
+		}
+		if !ok {
+			w = 1
+		}
+		n += w
+	}
+	return n
+}
+
+// listeningOnAll returns true when the host is listening on port on every one
+// of e.DstIPs.
+func (t *Tracker) listeningOnAll(e *TrackerEntry, port int) bool {
+	if t.listening == nil {
+		return false
+	}
+	for _, ip := range e.DstIPs {
+		if !t.listening.has(e.Protocol, *ip, port) {
+			return false
+		}
+	}
+	return len(e.DstIPs) > 0
+}
+
+// Add adds the connection v into the tracker. By default connections are
+// tracked in a Src IP + Dst IP tuple, see Aggregation, and separately for each
+// Protocol. A port scan is detected at most once per window, connections
+// after that are folded into the entry and detected with it in the next
+// window. The host's answers to SYNs are ignored unless only unanswered SYNs
+// are counted.
 func (t *Tracker) Add(v *Connection) {
+	if !v.Protocol.hasPorts() || (v.Stealth != ProbeNone) != (t.kind == KindStealth) {
+		return
+	}
+	if v.Reply != ReplyNone && !t.unanswered {
+		return
+	}
 	t.l.Lock()
-	// TODO(michaelmcallister): clarify if port scanning is *any* dst IP on
-	// the interface, or a specific one. With the current implementation a
-	// port scanner could scan up to 2 ports * N IP addresses on the interface.
-	// If it's any Dst IP address, change the key to simply be the Src IP.
-	key := fmt.Sprintf("[%s]>[%s]", v.Src.IP, v.Dst.IP)
+	key := protocolKey(v, t.key(v))
 	log.V(2).Infof("Tracking entry %s -> %s", v.Src, v.Dst)
-	_, ok := t.m[key]
-	if !ok {
-		t.m[key] = &TrackerEntry{
-			DstIP:  &v.Dst.IP,
-			SrcIP:  &v.Src.IP,
-			Ports:  make(map[int]int),
-			expiry: time.Now().Add(t.maxAge),
+	if t.packetClock && v.Time.After(t.latest) {
+		t.latest = v.Time
+	}
+	now := t.now()
+	e, ok := t.m[key]
+	// The entry may have expired without being removed yet.
+	if !ok || now.After(e.expiry) {
+		e = &TrackerEntry{
+			Kind:      t.kind,
+			Protocol:  v.Protocol,
+			DstIP:     &v.Dst.IP,
+			SrcIP:     &v.Src.IP,
+			Ports:     make(map[int]int),
+			FirstSeen: now,
+			seen:      make(map[string]bool),
+			lastHit:   make(map[int]time.Time),
+			pending:   make(map[string]held),
+			early:     make(map[string]held),
+		}
+		t.m[key] = e
+		if v.Reply != ReplyNone {
+			// An entry holding only an answer is removed if its SYN
+			// doesn't follow.
+			e.expiry = now.Add(answerTimeout)
 		}
 	}
-	t.m[key].Ports[v.Dst.Port]++
-	if len(t.m[key].Ports) > t.minimumPortScanned {
-		log.V(2).Infof("%s scanned > %d", key, t.minimumPortScanned)
-		t.portScanners <- t.m[key]
+	if v.Reply != ReplyNone {
+		e.answer(v, now)
+		t.settleAndDetect(key, e, now)
+		return
+	}
+	// Only the ports connected to within the last maxAge count.
+	e.slide(now.Add(-t.maxAge))
+	e.LastSeen = now
+	e.expiry = now.Add(t.maxAge)
+	if t.unanswered && v.Protocol == ProtocolTCP {
+		e.syn(v, now)
+	} else {
+		e.add(v, now)
+	}
+	if e.OS == nil {
+		e.OS = t.os.Match(v)
+	}
+	t.settleAndDetect(key, e, now)
+}
+
+// settleAndDetect counts the SYNs in e that went unanswered, when only those
+// are counted, and emits e if it's now a port scan. The caller must hold t.l,
+// which is released.
+func (t *Tracker) settleAndDetect(key string, e *TrackerEntry, now time.Time) {
+	if t.unanswered {
+		e.settle(now.Add(-answerTimeout), now)
 	}
+	c := t.detect(key, e, now)
 	t.l.Unlock()
+	if c != nil {
+		t.emit(c)
+	}
+}
+
+// detect returns a copy of e to report when it scores more than
+// minimumPortScanned and is due, or nil. The caller must hold t.l.
+func (t *Tracker) detect(key string, e *TrackerEntry, now time.Time) *TrackerEntry {
+	score := t.score(e)
+	if score <= t.minimumPortScanned || !e.due(now, t.maxAge) {
+		return nil
+	}
+	log.V(2).Infof("%s scored %d > %d", key, score, t.minimumPortScanned)
+	e.reported = now
+	return e.copy()
+}
+
+// emit sends the port scan c, a copy of its entry.
+func (t *Tracker) emit(c *TrackerEntry) {
+	t.detections.emit(&Detection{
+		Detector:  t.Name(),
+		SrcIPs:    c.SrcIPs,
+		Evidence:  c,
+		Severity:  SeverityHigh,
+		FirstSeen: c.FirstSeen,
+		LastSeen:  c.LastSeen,
+	})
 }
 
-// PortScanners returns a channel that callers can retrieve Entries that
-// scan multiple ports.
-func (t *Tracker) PortScanners() chan *TrackerEntry {
-	return t.portScanners
+// Name returns the name of the Tracker's detections.
+func (t *Tracker) Name() string {
+	return string(t.kind)
+}
+
+// Detections returns a channel that callers can retrieve sources that scan
+// multiple ports from, the Evidence is a *TrackerEntry.
+func (t *Tracker) Detections() chan *Detection {
+	return t.detections.c
 }
 
 // Connections returns the total number of currently tracked connections.
@@ -104,6 +523,39 @@ func (t *Tracker) Connections() int {
 	return count
 }
 
+// flush counts every SYN still waiting on an answer as unanswered, and emits
+// the entries that are now port scans. Once the packet clock stops, the
+// answers to the SYNs at the end of a capture are never coming.
+func (t *Tracker) flush() {
+	t.l.Lock()
+	now := t.now()
+	var detected []*TrackerEntry
+	for k, v := range t.m {
+		if now.After(v.expiry) {
+			continue
+		}
+		// Every pending SYN was added at or before now.
+		v.settle(now.Add(time.Nanosecond), now)
+		if c := t.detect(k, v, now); c != nil {
+			detected = append(detected, c)
+		}
+	}
+	t.l.Unlock()
+	for _, c := range detected {
+		t.emit(c)
+	}
+}
+
+// Close stops expiring entries and refreshing the listening ports, and closes
+// the Detections channel. When telling time by the packets, the SYNs still
+// waiting on an answer are counted first.
 func (t *Tracker) Close() {
-	close(t.portScanners)
+	close(t.done)
+	if t.listening != nil {
+		t.listening.Close()
+	}
+	if t.packetClock && t.unanswered {
+		t.flush()
+	}
+	t.detections.close()
 }
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"fmt"
 	"net"
 	"testing"
 	"time"
@@ -9,8 +10,71 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
+// conn returns a Connection from src to port on dst.
+func conn(src, dst net.IP, port int) *Connection {
+	return &Connection{
+		Src: &net.TCPAddr{IP: src, Port: 41832},
+		Dst: &net.TCPAddr{IP: dst, Port: port},
+	}
+}
+
+// udp returns c as a UDP datagram, or the port unreachable reply to one.
+func udp(c *Connection, unreachable bool) *Connection {
+	c.Protocol = ProtocolUDP
+	c.Unreachable = unreachable
+	return c
+}
+
+// sctp returns c as an SCTP INIT.
+func sctp(c *Connection) *Connection {
+	c.Protocol = ProtocolSCTP
+	return c
+}
+
+// epoch is the time that at makes connections relative to.
+var epoch = time.Unix(1624689612, 0)
+
+// at returns c, made the given seconds after epoch.
+func at(seconds int, c *Connection) *Connection {
+	c.Time = epoch.Add(time.Duration(seconds) * time.Second)
+	return c
+}
+
+// host returns the IP prefix.n, eg. host("10.0.0", 1) is 10.0.0.1.
+func host(prefix string, n int) net.IP {
+	return net.ParseIP(fmt.Sprintf("%s.%d", prefix, n))
+}
+
+// ips returns the IP prefix.n for each of hosts.
+func ips(prefix string, hosts ...int) []*net.IP {
+	var v []*net.IP
+	for _, n := range hosts {
+		ip := host(prefix, n)
+		v = append(v, &ip)
+	}
+	return v
+}
+
+// collect adds each of in to d, closing it once they're all added, and
+// returns the Detections that d emitted.
+func collect(d Detector, in []*Connection) []*Detection {
+	go func() {
+		defer d.Close()
+		for _, c := range in {
+			d.Add(c)
+		}
+	}()
+	var got []*Detection
+	for v := range d.Detections() {
+		got = append(got, v)
+	}
+	return got
+}
+
 func TestAdding(t *testing.T) {
 	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	neighbourSrcIP, outsideSrcIP := net.ParseIP("192.168.86.159"), net.ParseIP("192.168.87.1")
+	otherDstIP := net.ParseIP("192.168.86.192")
 
 	// Let's move quickly in the tests.
 	const evaluationTime = time.Millisecond
@@ -19,6 +83,7 @@ func TestAdding(t *testing.T) {
 		minimumPortScanned int
 		wait               time.Duration
 		maxAge             time.Duration
+		key                keyFunc
 		in                 []*Connection
 		want               []*TrackerEntry
 		wantConnections    int
@@ -72,9 +137,12 @@ func TestAdding(t *testing.T) {
 			},
 			want: []*TrackerEntry{
 				{
-					DstIP: &dstIP,
-					SrcIP: &srcIP,
-					Ports: map[int]int{7: 1, 9: 1, 1992: 1, 80: 1},
+					Kind:   KindPortScan,
+					DstIP:  &dstIP,
+					SrcIP:  &srcIP,
+					DstIPs: []*net.IP{&dstIP},
+					SrcIPs: []*net.IP{&srcIP},
+					Ports:  map[int]int{7: 1, 9: 1, 1992: 1, 80: 1},
 				},
 			},
 		},
@@ -117,10 +185,154 @@ func TestAdding(t *testing.T) {
 			},
 			want: nil,
 		},
+		{
+			desc:               "test ports scanned across local IPs are tracked separately",
+			minimumPortScanned: 3,
+			maxAge:             time.Minute,
+			wantConnections:    4,
+			in: []*Connection{
+				conn(srcIP, dstIP, 7),
+				conn(srcIP, dstIP, 9),
+				conn(srcIP, otherDstIP, 80),
+				conn(srcIP, otherDstIP, 1992),
+			},
+			want: nil,
+		},
+		{
+			desc:               "test ports scanned across local IPs by source",
+			minimumPortScanned: 3,
+			maxAge:             time.Minute,
+			key:                srcKey,
+			wantConnections:    4,
+			in: []*Connection{
+				conn(srcIP, dstIP, 7),
+				conn(srcIP, dstIP, 9),
+				conn(srcIP, otherDstIP, 80),
+				conn(srcIP, otherDstIP, 1992),
+			},
+			want: []*TrackerEntry{
+				{
+					Kind:   KindPortScan,
+					DstIP:  &dstIP,
+					SrcIP:  &srcIP,
+					DstIPs: []*net.IP{&dstIP, &otherDstIP},
+					SrcIPs: []*net.IP{&srcIP},
+					Ports:  map[int]int{7: 1, 9: 1, 80: 1, 1992: 1},
+				},
+			},
+		},
+		{
+			desc:               "test ports scanned from neighbouring IPs by source prefix",
+			minimumPortScanned: 3,
+			maxAge:             time.Minute,
+			key:                srcPrefixKey(24, 64),
+			wantConnections:    5,
+			in: []*Connection{
+				conn(srcIP, dstIP, 7),
+				conn(srcIP, dstIP, 9),
+				conn(neighbourSrcIP, dstIP, 80),
+				conn(outsideSrcIP, dstIP, 22),
+				conn(neighbourSrcIP, dstIP, 1992),
+			},
+			want: []*TrackerEntry{
+				{
+					Kind:   KindPortScan,
+					DstIP:  &dstIP,
+					SrcIP:  &srcIP,
+					DstIPs: []*net.IP{&dstIP},
+					SrcIPs: []*net.IP{&srcIP, &neighbourSrcIP},
+					Ports:  map[int]int{7: 1, 9: 1, 80: 1, 1992: 1},
+				},
+			},
+		},
+		{
+			desc:               "test stealth probes are left to the stealth Tracker",
+			minimumPortScanned: 3,
+			maxAge:             time.Minute,
+			wantConnections:    3,
+			in: []*Connection{
+				conn(srcIP, dstIP, 7),
+				conn(srcIP, dstIP, 9),
+				conn(srcIP, dstIP, 80),
+				{
+					Src:     &net.TCPAddr{IP: srcIP, Port: 41832},
+					Dst:     &net.TCPAddr{IP: dstIP, Port: 1992},
+					Stealth: ProbeFIN,
+				},
+			},
+			want: nil,
+		},
+		{
+			desc:               "test UDP ports are tracked separately from TCP ones",
+			minimumPortScanned: 3,
+			maxAge:             time.Minute,
+			wantConnections:    4,
+			in: []*Connection{
+				conn(srcIP, dstIP, 53),
+				conn(srcIP, dstIP, 161),
+				udp(conn(srcIP, dstIP, 53), false),
+				udp(conn(srcIP, dstIP, 161), false),
+			},
+			want: nil,
+		},
+		{
+			desc:               "test SCTP INITs are counted like TCP SYNs",
+			minimumPortScanned: 3,
+			maxAge:             time.Minute,
+			wantConnections:    5,
+			in: []*Connection{
+				conn(srcIP, dstIP, 2905),
+				sctp(conn(srcIP, dstIP, 2905)),
+				sctp(conn(srcIP, dstIP, 3868)),
+				sctp(conn(srcIP, dstIP, 9899)),
+				sctp(conn(srcIP, dstIP, 36412)),
+			},
+			want: []*TrackerEntry{
+				{
+					Kind:     KindPortScan,
+					Protocol: ProtocolSCTP,
+					DstIP:    &dstIP,
+					SrcIP:    &srcIP,
+					DstIPs:   []*net.IP{&dstIP},
+					SrcIPs:   []*net.IP{&srcIP},
+					Ports:    map[int]int{2905: 1, 3868: 1, 9899: 1, 36412: 1},
+				},
+			},
+		},
+		{
+			desc:               "test UDP port scan with port unreachable replies",
+			minimumPortScanned: 3,
+			maxAge:             time.Minute,
+			wantConnections:    5,
+			in: []*Connection{
+				udp(conn(srcIP, dstIP, 53), false),
+				udp(conn(srcIP, dstIP, 53), false),
+				// The replies to datagrams that were seen don't count.
+				udp(conn(srcIP, dstIP, 53), true),
+				udp(conn(srcIP, dstIP, 123), false),
+				udp(conn(srcIP, dstIP, 123), true),
+				udp(conn(srcIP, dstIP, 161), true),
+				udp(conn(srcIP, dstIP, 500), true),
+			},
+			want: []*TrackerEntry{
+				{
+					Kind:     KindPortScan,
+					Protocol: ProtocolUDP,
+					DstIP:    &dstIP,
+					SrcIP:    &srcIP,
+					DstIPs:   []*net.IP{&dstIP},
+					SrcIPs:   []*net.IP{&srcIP},
+					Ports:    map[int]int{53: 2, 123: 1, 161: 1, 500: 1},
+				},
+			},
+		},
 	}
 	for _, tC := range testCases {
 		t.Run(tC.desc, func(t *testing.T) {
 			tkr := newTracker(tC.maxAge, evaluationTime, tC.minimumPortScanned)
+			if tC.key != nil {
+				tkr.key = tC.key
+			}
 			var got []*TrackerEntry
 			go func() {
 				defer tkr.Close()
@@ -130,14 +342,12 @@ func TestAdding(t *testing.T) {
 				}
 			}()
 
-			for i := range tkr.PortScanners() {
-				if i != nil {
-					got = append(got, i)
-				}
+			for d := range tkr.Detections() {
+				got = append(got, d.Evidence.(*TrackerEntry))
 			}
 
-			if diff := cmp.Diff(tC.want, got, cmpopts.IgnoreUnexported(TrackerEntry{})); diff != "" {
-				t.Errorf("PortScanners() mismatch (-want +got):\n%s", diff)
+			if diff := cmp.Diff(tC.want, got, cmpopts.IgnoreUnexported(TrackerEntry{}), cmpopts.IgnoreFields(TrackerEntry{}, "FirstSeen", "LastSeen")); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
 			}
 
 			c := tkr.Connections()
@@ -147,3 +357,284 @@ func TestAdding(t *testing.T) {
 		})
 	}
 }
+
+func TestSlidingWindow(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	// to returns a Connection to port.
+	to := func(port int) *Connection {
+		return conn(srcIP, dstIP, port)
+	}
+	testCases := []struct {
+		desc            string
+		in              []*Connection
+		want            []*TrackerEntry
+		wantConnections int
+	}{
+		{
+			desc: "test ports straddling the first connection's window are detected",
+			in:   []*Connection{at(0, to(1)), at(59, to(2)), at(60, to(3)), at(61, to(4)), at(62, to(5))},
+			want: []*TrackerEntry{
+				{
+					Kind:      KindPortScan,
+					DstIP:     &dstIP,
+					SrcIP:     &srcIP,
+					DstIPs:    []*net.IP{&dstIP},
+					SrcIPs:    []*net.IP{&srcIP},
+					Ports:     map[int]int{2: 1, 3: 1, 4: 1, 5: 1},
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(62 * time.Second),
+				},
+			},
+			wantConnections: 4,
+		},
+		{
+			desc: "test a port scan is detected once per window",
+			in:   []*Connection{at(0, to(1)), at(1, to(2)), at(2, to(3)), at(3, to(4)), at(4, to(5)), at(5, to(6)), at(63, to(7))},
+			want: []*TrackerEntry{
+				{
+					Kind:      KindPortScan,
+					DstIP:     &dstIP,
+					SrcIP:     &srcIP,
+					DstIPs:    []*net.IP{&dstIP},
+					SrcIPs:    []*net.IP{&srcIP},
+					Ports:     map[int]int{1: 1, 2: 1, 3: 1, 4: 1},
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(3 * time.Second),
+				},
+				// Ports 5 and 6 are folded into the entry, and detected with
+				// it a window later.
+				{
+					Kind:      KindPortScan,
+					DstIP:     &dstIP,
+					SrcIP:     &srcIP,
+					DstIPs:    []*net.IP{&dstIP},
+					SrcIPs:    []*net.IP{&srcIP},
+					Ports:     map[int]int{4: 1, 5: 1, 6: 1, 7: 1},
+					FirstSeen: epoch,
+					LastSeen:  epoch.Add(63 * time.Second),
+				},
+			},
+			wantConnections: 4,
+		},
+		{
+			desc:            "test ports spread wider than the window aren't detected",
+			in:              []*Connection{at(0, to(1)), at(30, to(2)), at(60, to(3)), at(90, to(4)), at(120, to(5))},
+			wantConnections: 3,
+		},
+		{
+			desc:            "test repeated connections to a port are counted while it stays in the window",
+			in:              []*Connection{at(0, to(1)), at(0, to(1)), at(50, to(1)), at(100, to(2))},
+			wantConnections: 4,
+		},
+		{
+			desc:            "test repeated connections to a port leave the window",
+			in:              []*Connection{at(0, to(1)), at(0, to(1)), at(50, to(1)), at(111, to(2))},
+			wantConnections: 1,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			// The ticker never fires, so ports only slide out of the window
+			// as connections are added.
+			tkr := newTracker(time.Minute, time.Hour, 3)
+			tkr.packetClock = true
+			var got []*TrackerEntry
+			for _, d := range collect(tkr, tC.in) {
+				got = append(got, d.Evidence.(*TrackerEntry))
+			}
+			if diff := cmp.Diff(tC.want, got, cmpopts.IgnoreUnexported(TrackerEntry{})); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+			if c := tkr.Connections(); c != tC.wantConnections {
+				t.Errorf("tkr.Connections() = %d, want connections = %d", c, tC.wantConnections)
+			}
+		})
+	}
+}
+
+func TestWeightedPorts(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	weights := map[Protocol]map[int]int{
+		ProtocolTCP: {80: 0, 443: 0, 8080: 1, 22: 2, 3306: 2, 6379: 2},
+		ProtocolUDP: {53: 0},
+	}
+	testCases := []struct {
+		desc  string
+		ports []int
+		udp   bool
+		want  []map[int]int
+	}{
+		{
+			desc:  "test a client of served ports isn't a port scanner",
+			ports: []int{80, 443, 8080},
+		},
+		{
+			desc:  "test a probe of sensitive ports is a port scanner",
+			ports: []int{22, 3306, 6379},
+			// 22 and 3306 already score more than 3.
+			want: []map[int]int{{22: 1, 3306: 1}},
+		},
+		{
+			desc:  "test unweighted ports score 1",
+			ports: []int{22, 1992, 7},
+			want:  []map[int]int{{22: 1, 1992: 1, 7: 1}},
+		},
+		{
+			desc:  "test ports are weighted per protocol",
+			ports: []int{53, 80, 443, 8080, 161},
+			udp:   true,
+			want:  []map[int]int{{53: 1, 80: 1, 443: 1, 8080: 1, 161: 1}},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tkr := newTracker(time.Minute, time.Hour, 3)
+			tkr.weights = weights
+			var in []*Connection
+			for _, p := range tC.ports {
+				c := conn(srcIP, dstIP, p)
+				if tC.udp {
+					c = udp(c, false)
+				}
+				in = append(in, c)
+			}
+			var got []map[int]int
+			for _, d := range collect(tkr, in) {
+				got = append(got, d.Evidence.(*TrackerEntry).Ports)
+			}
+			if diff := cmp.Diff(tC.want, got); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUnansweredSYNs(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	// atMS returns a SYN to port, or the host's answer r to one, made the
+	// given milliseconds after epoch.
+	atMS := func(ms, port int, r TCPReply) *Connection {
+		c := conn(srcIP, dstIP, port)
+		c.Reply = r
+		c.Time = epoch.Add(time.Duration(ms) * time.Millisecond)
+		return c
+	}
+	// from returns c with its source port set to port.
+	from := func(port int, c *Connection) *Connection {
+		c.Src.Port = port
+		return c
+	}
+	testCases := []struct {
+		desc       string
+		unanswered bool
+		in         []*Connection
+		want       []map[int]int
+	}{
+		{
+			desc:       "test SYNs answered with a SYN-ACK aren't counted",
+			unanswered: true,
+			in: []*Connection{
+				atMS(0, 22, ReplyNone), atMS(1, 22, ReplySYNACK),
+				atMS(10, 80, ReplyNone), atMS(11, 80, ReplySYNACK),
+				atMS(20, 443, ReplyNone), atMS(21, 443, ReplySYNACK),
+				atMS(30, 8080, ReplyNone), atMS(31, 8080, ReplySYNACK),
+				atMS(5000, 8443, ReplyNone),
+			},
+		},
+		{
+			desc:       "test SYNs answered with a RST are counted",
+			unanswered: true,
+			in: []*Connection{
+				atMS(0, 22, ReplyNone), atMS(1, 22, ReplySYNACK),
+				atMS(10, 3306, ReplyNone), atMS(11, 3306, ReplyRST),
+				atMS(20, 6379, ReplyNone), atMS(21, 6379, ReplyRST),
+				atMS(30, 9200, ReplyNone), atMS(31, 9200, ReplyRST),
+				atMS(40, 5432, ReplyNone), atMS(41, 5432, ReplyRST),
+			},
+			want: []map[int]int{{3306: 1, 6379: 1, 9200: 1, 5432: 1}},
+		},
+		{
+			desc:       "test answers read before their SYN are matched",
+			unanswered: true,
+			in: []*Connection{
+				atMS(1, 22, ReplySYNACK), atMS(0, 22, ReplyNone),
+				atMS(11, 80, ReplySYNACK), atMS(10, 80, ReplyNone),
+				atMS(21, 443, ReplySYNACK), atMS(20, 443, ReplyNone),
+				atMS(31, 8080, ReplySYNACK), atMS(30, 8080, ReplyNone),
+				atMS(5000, 8443, ReplyNone),
+			},
+		},
+		{
+			desc:       "test RSTs read before their SYN are counted",
+			unanswered: true,
+			in: []*Connection{
+				atMS(11, 3306, ReplyRST), atMS(10, 3306, ReplyNone),
+				atMS(21, 6379, ReplyRST), atMS(20, 6379, ReplyNone),
+				atMS(31, 9200, ReplyRST), atMS(30, 9200, ReplyNone),
+				atMS(41, 5432, ReplyRST), atMS(40, 5432, ReplyNone),
+			},
+			want: []map[int]int{{3306: 1, 6379: 1, 9200: 1, 5432: 1}},
+		},
+		{
+			desc:       "test answers to another connection aren't matched",
+			unanswered: true,
+			in: []*Connection{
+				atMS(0, 22, ReplyNone), from(50000, atMS(1, 22, ReplyRST)), atMS(2, 22, ReplySYNACK),
+				atMS(10, 80, ReplyNone), from(50001, atMS(11, 80, ReplyRST)), atMS(12, 80, ReplySYNACK),
+				atMS(20, 443, ReplyNone), from(50002, atMS(21, 443, ReplyRST)), atMS(22, 443, ReplySYNACK),
+				atMS(30, 8080, ReplyNone), from(50003, atMS(31, 8080, ReplyRST)), atMS(32, 8080, ReplySYNACK),
+				atMS(5000, 8443, ReplyNone),
+			},
+		},
+		{
+			desc:       "test SYNs that go unanswered are counted",
+			unanswered: true,
+			in: []*Connection{
+				atMS(0, 3306, ReplyNone),
+				atMS(10, 6379, ReplyNone),
+				atMS(20, 9200, ReplyNone),
+				atMS(30, 5432, ReplyNone),
+				atMS(3000, 22, ReplyNone),
+			},
+			want: []map[int]int{{3306: 1, 6379: 1, 9200: 1, 5432: 1}},
+		},
+		{
+			desc:       "test SYNs still waiting on an answer when the capture ends are counted",
+			unanswered: true,
+			in: []*Connection{
+				atMS(0, 22, ReplyNone), atMS(1, 22, ReplySYNACK),
+				atMS(10, 3306, ReplyNone),
+				atMS(20, 6379, ReplyNone),
+				atMS(30, 9200, ReplyNone),
+				atMS(40, 5432, ReplyNone),
+			},
+			want: []map[int]int{{3306: 1, 6379: 1, 9200: 1, 5432: 1}},
+		},
+		{
+			desc: "test answers are ignored by default",
+			in: []*Connection{
+				atMS(0, 22, ReplyNone), atMS(1, 22, ReplySYNACK),
+				atMS(10, 80, ReplyNone), atMS(11, 80, ReplySYNACK),
+				atMS(20, 443, ReplyNone), atMS(21, 443, ReplySYNACK),
+				atMS(30, 8080, ReplyNone), atMS(31, 8080, ReplySYNACK),
+			},
+			want: []map[int]int{{22: 1, 80: 1, 443: 1, 8080: 1}},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			// The ticker never fires, so SYNs only settle as connections
+			// are added.
+			tkr := newTracker(time.Minute, time.Hour, 3)
+			tkr.packetClock = true
+			tkr.unanswered = tC.unanswered
+			var got []map[int]int
+			for _, d := range collect(tkr, tC.in) {
+				got = append(got, d.Evidence.(*TrackerEntry).Ports)
+			}
+			if diff := cmp.Diff(tC.want, got); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
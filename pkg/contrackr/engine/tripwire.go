@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// Tripwire is a connection to a port that nothing legitimate ever connects
+// to.
+type Tripwire struct {
+	SrcIP    *net.IP
+	DstIP    *net.IP
+	Protocol Protocol
+	// Port is the tripwire that fired.
+	Port int
+	Time time.Time
+}
+
+// String returns the source, destination and tripwire of w.
+func (w *Tripwire) String() string {
+	return fmt.Sprintf("%s -> %s tripped %s port %d", w.SrcIP, w.DstIP, w.Protocol, w.Port)
+}
+
+// tripwireTracker is the Detector for connections to tripwire ports, which
+// are detected, and so blocked, on the first connection whatever the minimum
+// ports scanned. A source is detected at most once per window for each
+// protocol, the Evidence is a *Tripwire.
+type tripwireTracker struct {
+	*onceTracker
+	ports map[int]bool
+	// blockSpoofable blocks the sources of UDP and SCTP tripwires too. A
+	// single datagram or INIT is enough to trip one, and its source may be
+	// spoofed to get any address blocked, so by default they're only logged.
+	blockSpoofable bool
+}
+
+// newTripwireTracker takes the tripwire ports, the window a source is detected
+// at most once within, and whether the sources of UDP and SCTP tripwires
+// should be blocked and returns an instance of tripwireTracker.
+func newTripwireTracker(ports []int, window, evaluationInterval time.Duration, blockSpoofable bool) *tripwireTracker {
+	t := &tripwireTracker{
+		onceTracker:    newOnceTracker(window, evaluationInterval),
+		ports:          make(map[int]bool),
+		blockSpoofable: blockSpoofable,
+	}
+	for _, p := range ports {
+		t.ports[p] = true
+	}
+	return t
+}
+
+// Add adds the connection v into the tracker, it's detected if it's to a
+// tripwire port. UDP and SCTP tripwires are only logged, unless
+// blockSpoofable is set.
+func (t *tripwireTracker) Add(v *Connection) {
+	if !v.Protocol.hasPorts() || v.Reply != ReplyNone || !t.ports[v.Dst.Port] {
+		return
+	}
+	now, ok := t.report(v)
+	if !ok {
+		return
+	}
+	log.V(2).Infof("%s tripped %s port %d", v.Src.IP, v.Protocol, v.Dst.Port)
+	w := &Tripwire{SrcIP: &v.Src.IP, DstIP: &v.Dst.IP, Protocol: v.Protocol, Port: v.Dst.Port, Time: now}
+	severity := SeverityHigh
+	if v.Protocol != ProtocolTCP && !t.blockSpoofable {
+		severity = SeverityInfo
+	}
+	t.detections.emit(&Detection{
+		Detector:  t.Name(),
+		SrcIPs:    []*net.IP{w.SrcIP},
+		Evidence:  w,
+		Severity:  severity,
+		FirstSeen: now,
+		LastSeen:  now,
+	})
+}
+
+// Name returns the name of the tripwireTracker's detections.
+func (t *tripwireTracker) Name() string {
+	return "tripwire"
+}
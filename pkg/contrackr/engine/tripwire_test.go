@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTripwireTracker(t *testing.T) {
+	srcIP, dstIP := net.ParseIP("192.168.86.158"), net.ParseIP("192.168.86.191")
+	// to returns a Connection to port.
+	to := func(port int) *Connection {
+		return conn(srcIP, dstIP, port)
+	}
+	testCases := []struct {
+		desc string
+		// blockSpoofable blocks the sources of UDP and SCTP tripwires.
+		blockSpoofable bool
+		in             []*Connection
+		want           []*Tripwire
+		wantSeverities []Severity
+	}{
+		{
+			desc: "test a single connection to a tripwire is detected",
+			in:   []*Connection{at(0, to(80)), at(1, to(445))},
+			want: []*Tripwire{
+				{SrcIP: &srcIP, DstIP: &dstIP, Port: 445, Time: epoch.Add(time.Second)},
+			},
+			wantSeverities: []Severity{SeverityHigh},
+		},
+		{
+			desc: "test tripwires are detected once per window",
+			in:   []*Connection{at(0, to(23)), at(1, to(445)), at(60, to(3389))},
+			want: []*Tripwire{
+				{SrcIP: &srcIP, DstIP: &dstIP, Port: 23, Time: epoch},
+				{SrcIP: &srcIP, DstIP: &dstIP, Port: 3389, Time: epoch.Add(time.Minute)},
+			},
+			wantSeverities: []Severity{SeverityHigh, SeverityHigh},
+		},
+		{
+			desc: "test UDP tripwires are only logged by default",
+			in:   []*Connection{udp(at(0, to(23)), false), sctp(at(1, to(445)))},
+			want: []*Tripwire{
+				{SrcIP: &srcIP, DstIP: &dstIP, Protocol: ProtocolUDP, Port: 23, Time: epoch},
+				{SrcIP: &srcIP, DstIP: &dstIP, Protocol: ProtocolSCTP, Port: 445, Time: epoch.Add(time.Second)},
+			},
+			wantSeverities: []Severity{SeverityInfo, SeverityInfo},
+		},
+		{
+			desc: "test a logged UDP tripwire doesn't stop a TCP one from blocking",
+			in:   []*Connection{udp(at(0, to(23)), false), at(1, to(23))},
+			want: []*Tripwire{
+				{SrcIP: &srcIP, DstIP: &dstIP, Protocol: ProtocolUDP, Port: 23, Time: epoch},
+				{SrcIP: &srcIP, DstIP: &dstIP, Port: 23, Time: epoch.Add(time.Second)},
+			},
+			wantSeverities: []Severity{SeverityInfo, SeverityHigh},
+		},
+		{
+			desc:           "test UDP tripwires block when spoofable tripwires are blocked",
+			blockSpoofable: true,
+			in:             []*Connection{udp(at(0, to(23)), false)},
+			want: []*Tripwire{
+				{SrcIP: &srcIP, DstIP: &dstIP, Protocol: ProtocolUDP, Port: 23, Time: epoch},
+			},
+			wantSeverities: []Severity{SeverityHigh},
+		},
+		{
+			desc: "test other ports aren't detected",
+			in:   []*Connection{at(0, to(22)), at(1, to(80)), at(2, to(443)), at(3, to(8080))},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			tkr := newTripwireTracker([]int{23, 445, 3389}, time.Minute, time.Hour, tC.blockSpoofable)
+			tkr.packetClock = true
+			var got []*Tripwire
+			var gotSeverities []Severity
+			for _, d := range collect(tkr, tC.in) {
+				got = append(got, d.Evidence.(*Tripwire))
+				gotSeverities = append(gotSeverities, d.Severity)
+			}
+			if diff := cmp.Diff(tC.want, got); diff != "" {
+				t.Errorf("Detections() mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tC.wantSeverities, gotSeverities); diff != "" {
+				t.Errorf("Detections() severity mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
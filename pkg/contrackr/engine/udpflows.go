@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+// The range Linux allocates the local ports of outbound connections from by
+// default, see ip_local_port_range. A datagram to one of them is a reply to a
+// query the host sent (eg. to a DNS resolver), rather than a probe.
+const (
+	ephemeralPortMin = 32768
+	ephemeralPortMax = 60999
+)
+
+// udpFlowTimeout is how long a reply to a datagram the host sent is expected
+// within, it's the same as the kernel's connection tracking.
+const udpFlowTimeout = 30 * time.Second
+
+// maxUDPFlows caps how many of the datagrams the host sent are remembered.
+const maxUDPFlows = 65536
+
+// ephemeralPort returns true when port is in the ephemeral port range.
+func ephemeralPort(port int) bool {
+	return port >= ephemeralPortMin && port <= ephemeralPortMax
+}
+
+// udpFlows are the UDP flows the host recently sent datagrams on, so that the
+// replies to them aren't mistaken for probes.
+type udpFlows struct {
+	// protects everything below.
+	l sync.Mutex
+	// m is when a datagram was last sent on each flow.
+	m map[string]time.Time
+}
+
+// newUDPFlows returns an instance of udpFlows.
+func newUDPFlows() *udpFlows {
+	return &udpFlows{m: make(map[string]time.Time)}
+}
+
+// sent records the datagram c, that was sent by the host. Once maxUDPFlows
+// are remembered, the flows that timed out are forgotten to make room.
+func (f *udpFlows) sent(c *Connection) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if len(f.m) >= maxUDPFlows {
+		for k, t := range f.m {
+			if c.Time.Sub(t) > udpFlowTimeout {
+				delete(f.m, k)
+			}
+		}
+		if len(f.m) >= maxUDPFlows {
+			return
+		}
+	}
+	f.m[flowKey(c.Src, c.Dst)] = c.Time
+}
+
+// reply returns true when the datagram c is a reply to one the host sent
+// within udpFlowTimeout.
+func (f *udpFlows) reply(c *Connection) bool {
+	f.l.Lock()
+	defer f.l.Unlock()
+	t, ok := f.m[flowKey(c.Dst, c.Src)]
+	return ok && c.Time.Sub(t) <= udpFlowTimeout
+}